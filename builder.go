@@ -0,0 +1,227 @@
+package mqtt
+
+// PublishBuilder constructs a Publish message, validating the combination of
+// its fields when Build is called. The zero value is not usable; use
+// NewPublishBuilder.
+type PublishBuilder struct {
+	msg Publish
+}
+
+// NewPublishBuilder returns a PublishBuilder for a QoS 0 PUBLISH to topic,
+// with an empty payload.
+func NewPublishBuilder(topic string) *PublishBuilder {
+	return &PublishBuilder{msg: Publish{TopicName: topic, Payload: BytesPayload{}}}
+}
+
+// Payload sets the payload of the message.
+func (b *PublishBuilder) Payload(payload Payload) *PublishBuilder {
+	b.msg.Payload = payload
+	return b
+}
+
+// Qos sets the QoS level of the message.
+func (b *PublishBuilder) Qos(qos QosLevel) *PublishBuilder {
+	b.msg.Header.QosLevel = qos
+	return b
+}
+
+// Retain sets the RETAIN flag of the message.
+func (b *PublishBuilder) Retain(retain bool) *PublishBuilder {
+	b.msg.Header.Retain = retain
+	return b
+}
+
+// Dup sets the DUP flag of the message.
+func (b *PublishBuilder) Dup(dup bool) *PublishBuilder {
+	b.msg.Header.DupFlag = dup
+	return b
+}
+
+// MessageId sets the message ID, which is required for QoS 1 and 2, and must
+// not be set for QoS 0.
+func (b *PublishBuilder) MessageId(id uint16) *PublishBuilder {
+	b.msg.MessageId = id
+	return b
+}
+
+// Build returns a new Publish message, or an error if the message could not
+// be encoded. ErrMissingMessageId is returned if the QoS level requires a
+// message ID that has not been set, and ErrMessageIdOnQos0 if a message ID has
+// been set for QoS 0.
+func (b *PublishBuilder) Build() (*Publish, error) {
+	msg := b.msg
+	if !msg.Header.QosLevel.IsValid() {
+		return nil, ErrBadQos
+	}
+	if err := checkPublishMessageId(&msg); err != nil {
+		return nil, err
+	}
+	if err := msg.validate(); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// checkPublishMessageId returns ErrMissingMessageId if the QoS level of msg
+// requires a message ID that has not been set, and ErrMessageIdOnQos0 if a
+// message ID has been set for QoS 0.
+func checkPublishMessageId(msg *Publish) error {
+	if msg.Header.QosLevel.HasId() {
+		if msg.MessageId == 0 {
+			return ErrMissingMessageId
+		}
+	} else if msg.MessageId != 0 {
+		return ErrMessageIdOnQos0
+	}
+	return nil
+}
+
+// Option sets a field of a message created by New, returning an error if the
+// option does not apply to the message or conflicts with options applied
+// before it.
+type Option func(msg Message) error
+
+// New creates a message of the given type, as NewMessage does, and applies
+// opts to it in order. A CONNECT is created for MQTT 3.1.1 (protocol "MQTT",
+// version 4), and a PUBLISH with an empty payload. An error is returned if an
+// option fails, or if the resulting message could not be encoded.
+func New(msgType MessageType, opts ...Option) (Message, error) {
+	msg, err := NewMessage(msgType)
+	if err != nil {
+		return nil, err
+	}
+	switch msg := msg.(type) {
+	case *Connect:
+		msg.ProtocolName = "MQTT"
+		msg.ProtocolVersion = 4
+	case *Publish:
+		msg.Payload = BytesPayload{}
+	}
+
+	for _, opt := range opts {
+		if err := opt(msg); err != nil {
+			return nil, err
+		}
+	}
+
+	if msg, ok := msg.(*Publish); ok {
+		if err := checkPublishMessageId(msg); err != nil {
+			return nil, err
+		}
+	}
+	if err := Validate(msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// OptQos sets the QoS level of a PUBLISH. ErrMessageIdOnQos0 is returned if
+// qos is 0 and a message ID has already been set.
+func OptQos(qos QosLevel) Option {
+	return func(msg Message) error {
+		publish, ok := msg.(*Publish)
+		if !ok {
+			return ErrOptionNotApplicable
+		}
+		if !qos.IsValid() {
+			return ErrBadQos
+		}
+		if !qos.HasId() && publish.MessageId != 0 {
+			return ErrMessageIdOnQos0
+		}
+		publish.Header.QosLevel = qos
+		return nil
+	}
+}
+
+// OptTopic sets the topic name of a PUBLISH.
+func OptTopic(topic string) Option {
+	return func(msg Message) error {
+		publish, ok := msg.(*Publish)
+		if !ok {
+			return ErrOptionNotApplicable
+		}
+		publish.TopicName = topic
+		return nil
+	}
+}
+
+// OptPayload sets the payload of a PUBLISH.
+func OptPayload(payload Payload) Option {
+	return func(msg Message) error {
+		publish, ok := msg.(*Publish)
+		if !ok {
+			return ErrOptionNotApplicable
+		}
+		publish.Payload = payload
+		return nil
+	}
+}
+
+// OptRetain sets the RETAIN flag of a PUBLISH.
+func OptRetain(retain bool) Option {
+	return func(msg Message) error {
+		publish, ok := msg.(*Publish)
+		if !ok {
+			return ErrOptionNotApplicable
+		}
+		publish.Header.Retain = retain
+		return nil
+	}
+}
+
+// OptMessageId sets the message ID of any message that carries one. For a
+// PUBLISH, the QoS level must already have been set to 1 or 2 by OptQos, or
+// ErrMessageIdOnQos0 is returned. ErrMissingMessageId is returned if id is 0.
+func OptMessageId(id uint16) Option {
+	return func(msg Message) error {
+		if publish, ok := msg.(*Publish); ok && !publish.Header.QosLevel.HasId() {
+			return ErrMessageIdOnQos0
+		}
+		if id == 0 {
+			return ErrMissingMessageId
+		}
+		p := messageIdPtr(msg)
+		if p == nil {
+			return ErrOptionNotApplicable
+		}
+		*p = id
+		return nil
+	}
+}
+
+// OptClientId sets the client identifier of a CONNECT.
+func OptClientId(clientId string) Option {
+	return func(msg Message) error {
+		connect, ok := msg.(*Connect)
+		if !ok {
+			return ErrOptionNotApplicable
+		}
+		connect.ClientId = clientId
+		return nil
+	}
+}
+
+// OptKeepAlive sets the keep alive interval of a CONNECT, in seconds.
+func OptKeepAlive(keepAlive uint16) Option {
+	return func(msg Message) error {
+		connect, ok := msg.(*Connect)
+		if !ok {
+			return ErrOptionNotApplicable
+		}
+		connect.KeepAliveTimer = keepAlive
+		return nil
+	}
+}
+
+// OptCleanSession sets the clean session flag of a CONNECT.
+func OptCleanSession(clean bool) Option {
+	return func(msg Message) error {
+		connect, ok := msg.(*Connect)
+		if !ok {
+			return ErrOptionNotApplicable
+		}
+		connect.CleanSession = clean
+		return nil
+	}
+}
@@ -0,0 +1,91 @@
+package mqtt
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"hash"
+	"io"
+)
+
+// EncodeChecksummed encodes msg to w, followed by the checksum of the encoded
+// message computed by h, as returned by h.Sum. This supports carrying MQTT
+// over lossy transports such as serial or radio links. The checksum width is
+// h.Size() bytes.
+func EncodeChecksummed(w io.Writer, msg Message, h hash.Hash) error {
+	buf := new(bytes.Buffer)
+	if err := msg.Encode(buf); err != nil {
+		return err
+	}
+	h.Reset()
+	h.Write(buf.Bytes())
+	buf.Write(h.Sum(nil))
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// ChecksummedDecoder decodes a stream of messages that are each followed by a
+// checksum, as written by EncodeChecksummed. Reads from the underlying reader
+// are buffered.
+type ChecksummedDecoder struct {
+	// Config provides specifics on how to decode messages, as for
+	// DecodeOneMessage.
+	Config DecoderConfig
+
+	r    *bufio.Reader
+	hash hash.Hash
+
+	// packet holds the encoded message and checksum being decoded.
+	packet bytes.Buffer
+}
+
+// NewChecksummedDecoder returns a ChecksummedDecoder that reads from r, and
+// verifies checksums computed by h (for example, crc32.NewIEEE()). The
+// Decoder may read data from r beyond the end of the messages that it has
+// returned.
+func NewChecksummedDecoder(r io.Reader, h hash.Hash) *ChecksummedDecoder {
+	return &ChecksummedDecoder{r: bufio.NewReader(r), hash: h}
+}
+
+// Decode reads the next message and its checksum from the stream. The whole
+// message is read before it is decoded, and ErrChecksumMismatch is returned
+// if the checksum does not match the message as read. The stream remains
+// positioned at the next message unless the corruption affected the message's
+// fixed header.
+func (d *ChecksummedDecoder) Decode() (Message, error) {
+	d.packet.Reset()
+
+	var hdr Header
+	_, packetRemaining, err := hdr.Decode(io.TeeReader(d.r, &d.packet))
+	if err != nil && !errors.Is(err, ErrBadQos) {
+		return nil, err
+	}
+
+	if max := decodeOptions(d.Config).MaxRemainingLength; max > 0 && packetRemaining > max {
+		return nil, ErrPacketTooLarge
+	}
+
+	sumSize := d.hash.Size()
+	if err != nil {
+		// The remaining length was decoded, so the message and its checksum
+		// can be skipped.
+		io.CopyN(io.Discard, d.r, int64(packetRemaining)+int64(sumSize))
+		return nil, err
+	}
+	if _, err := io.CopyN(&d.packet, d.r, int64(packetRemaining)+int64(sumSize)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	encoded := d.packet.Bytes()
+	msgLen := len(encoded) - sumSize
+	d.hash.Reset()
+	d.hash.Write(encoded[:msgLen])
+	if !bytes.Equal(d.hash.Sum(nil), encoded[msgLen:]) {
+		return nil, ErrChecksumMismatch
+	}
+
+	return DecodeOneMessage(bytes.NewReader(encoded[:msgLen]), d.Config)
+}
@@ -0,0 +1,200 @@
+package mqtt
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+// Decoder decodes a stream of messages from a reader, such as a network
+// connection. Reads from the underlying reader are buffered.
+type Decoder struct {
+	// Config provides specifics on how to decode messages, as for
+	// DecodeOneMessage.
+	Config DecoderConfig
+
+	// PacketTimeout, if non-zero, limits the time that a message may take to
+	// arrive once its first byte has been received, to defend against peers
+	// that stall part way through sending a message. It is only effective if
+	// the reader passed to NewDecoder supports read deadlines, as net.Conn
+	// does, and not if it is a *bufio.Reader.
+	//
+	// When PacketTimeout is set, the Decoder owns the read deadline of the
+	// underlying reader: Decode clears any deadline set by the caller before
+	// waiting for a message, and leaves no deadline set when it returns. As
+	// net.Conn has no way to get the current deadline, a caller's deadline
+	// cannot be restored, and callers should not set their own.
+	PacketTimeout time.Duration
+
+	// MaxPackets, if non-zero, limits the number of messages that may be read
+	// from the stream, including those that fail to decode. Once it is
+	// reached, Decode returns ErrMaxPackets without reading from the stream.
+	MaxPackets int
+
+	r countingReader
+
+	// packets is the number of messages read from the stream.
+	packets int
+
+	// conn is the underlying reader if it supports read deadlines.
+	conn readDeadliner
+
+	// body reads the body of the most recently decoded message. It is limited
+	// to the remaining length declared in the message's fixed header.
+	body io.LimitedReader
+
+	stats DecoderStats
+}
+
+// DecoderStats holds cumulative counts of the messages read by a Decoder.
+type DecoderStats struct {
+	// Messages is the number of messages decoded successfully.
+	Messages uint64
+
+	// ByType counts the messages decoded successfully, indexed by
+	// MessageType.
+	ByType [16]uint64
+
+	// Errors is the number of calls to Decode that returned an error, other
+	// than io.EOF at the end of the stream and ErrMaxPackets.
+	Errors uint64
+
+	// Bytes is the number of bytes consumed from the stream, including those
+	// of messages that failed to decode.
+	Bytes uint64
+}
+
+// NewDecoder returns a Decoder that reads from r. The Decoder may read data
+// from r beyond the end of the messages that it has returned. If r is a
+// *bufio.Reader, it is used directly rather than being wrapped in another
+// layer of buffering. The Decoder then cannot reach the reader underneath it
+// to set read deadlines, so PacketTimeout has no effect.
+func NewDecoder(r io.Reader) *Decoder {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	d := &Decoder{r: countingReader{r: br}}
+	d.conn, _ = r.(readDeadliner)
+	return d
+}
+
+// readDeadliner is implemented by readers that support read deadlines, such as
+// net.Conn.
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// Decode decodes the next message from the stream. The Payload of a decoded
+// Publish message must have been read completely before Decode is called
+// again.
+//
+// Decode always consumes exactly the remaining length declared by each
+// message's fixed header, whether or not the message decoded successfully. Any
+// part of the previous message's body that was left unread is skipped, so that
+// the stream stays aligned after a malformed message. If the stream ends
+// within the previous message's body, io.ErrUnexpectedEOF is returned.
+//
+// If a message is longer than the DecodeOptions.MaxRemainingLength of Config,
+// ErrPacketTooLarge is returned without its body being read. If PacketTimeout
+// is exceeded, ErrPacketTimeout is returned. In either case the stream is then
+// positioned part way through the message, and should be closed.
+func (d *Decoder) Decode() (msg Message, err error) {
+	if d.MaxPackets > 0 && d.packets >= d.MaxPackets {
+		return nil, ErrMaxPackets
+	}
+
+	start := d.r.n
+	var msgType MessageType
+	defer func() {
+		d.stats.Bytes = d.r.n
+		if err == nil {
+			d.stats.Messages++
+			d.stats.ByType[msgType]++
+		} else if err != io.EOF || d.r.n != start {
+			d.stats.Errors++
+		}
+	}()
+
+	if d.body.N > 0 {
+		io.Copy(io.Discard, &d.body)
+		if d.body.N > 0 {
+			d.body.N = 0
+			return nil, io.ErrUnexpectedEOF
+		}
+		start = d.r.n
+	}
+
+	if d.PacketTimeout > 0 && d.conn != nil {
+		if err = d.startPacketTimeout(); err != nil {
+			return nil, err
+		}
+		defer func() {
+			d.conn.SetReadDeadline(time.Time{})
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				err = ErrPacketTimeout
+			}
+		}()
+	}
+
+	var hdr Header
+	var packetRemaining int32
+	msgType, packetRemaining, err = hdr.Decode(&d.r)
+	if d.r.n != start {
+		d.packets++
+	}
+	if max := decodeOptions(d.Config).MaxRemainingLength; max > 0 && packetRemaining > max {
+		return nil, ErrPacketTooLarge
+	}
+	d.body = io.LimitedReader{R: &d.r, N: int64(packetRemaining)}
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err = NewMessage(msgType)
+	if err != nil {
+		return nil, err
+	}
+
+	return msg, decodeBody(&d.body, msg, hdr, msgType, packetRemaining, d.Config)
+}
+
+// startPacketTimeout waits without a deadline for the first byte of the next
+// message to arrive, and then sets the deadline for the rest of it.
+func (d *Decoder) startPacketTimeout() error {
+	if err := d.conn.SetReadDeadline(time.Time{}); err != nil {
+		return err
+	}
+	if _, err := d.r.r.Peek(1); err != nil {
+		return err
+	}
+	return d.conn.SetReadDeadline(time.Now().Add(d.PacketTimeout))
+}
+
+// Stats returns a snapshot of the counts of messages read so far.
+func (d *Decoder) Stats() DecoderStats {
+	d.stats.Bytes = d.r.n
+	return d.stats
+}
+
+// countingReader counts the bytes read from a bufio.Reader.
+type countingReader struct {
+	r *bufio.Reader
+	n uint64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += uint64(n)
+	return n, err
+}
+
+func (cr *countingReader) ReadByte() (byte, error) {
+	b, err := cr.r.ReadByte()
+	if err == nil {
+		cr.n++
+	}
+	return b, err
+}
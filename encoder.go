@@ -0,0 +1,28 @@
+package mqtt
+
+import (
+	"bufio"
+	"io"
+)
+
+// Encoder encodes a stream of messages to a writer, such as a network
+// connection. Writes to the underlying writer are buffered, so Flush must be
+// called for encoded messages to be sent.
+type Encoder struct {
+	w *bufio.Writer
+}
+
+// NewEncoder returns an Encoder that writes to w.
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: bufio.NewWriter(w)}
+}
+
+// Encode encodes msg to the stream.
+func (e *Encoder) Encode(msg Message) error {
+	return msg.Encode(e.w)
+}
+
+// Flush writes any buffered data to the underlying writer.
+func (e *Encoder) Flush() error {
+	return e.w.Flush()
+}
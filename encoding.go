@@ -3,41 +3,101 @@ package mqtt
 import (
 	"bytes"
 	"io"
+	"unicode/utf8"
 )
 
+// readByte reads a single byte from r, using io.ByteReader if r implements
+// it to avoid a Read call per byte. As with io.ReadFull, io.EOF is returned
+// if no byte could be read.
+func readByte(r io.Reader) (byte, error) {
+	if br, ok := r.(io.ByteReader); ok {
+		return br.ReadByte()
+	}
+	var b [1]byte
+	_, err := io.ReadFull(r, b[:])
+	return b[0], err
+}
+
 func getUint8(r io.Reader, packetRemaining *int32) uint8 {
 	if *packetRemaining < 1 {
-		raiseError(dataExceedsPacketError)
+		raiseError(ErrDataExceedsPacket)
 	}
 
-	var b [1]byte
-	if _, err := io.ReadFull(r, b[:]); err != nil {
+	b, err := readByte(r)
+	if err != nil {
 		raiseError(err)
 	}
 	*packetRemaining--
 
-	return b[0]
+	return b
 }
 
 func getUint16(r io.Reader, packetRemaining *int32) uint16 {
 	if *packetRemaining < 2 {
-		raiseError(dataExceedsPacketError)
+		raiseError(ErrDataExceedsPacket)
 	}
 
-	var b [2]byte
-	if _, err := io.ReadFull(r, b[:]); err != nil {
+	// Reading each byte avoids a buffer escaping to the heap, so that
+	// messages consisting only of a message ID decode without allocating.
+	hi, err := readByte(r)
+	if err != nil {
+		raiseError(err)
+	}
+	lo, err := readByte(r)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
 		raiseError(err)
 	}
 	*packetRemaining -= 2
 
-	return uint16(b[0])<<8 | uint16(b[1])
+	return uint16(hi)<<8 | uint16(lo)
+}
+
+func getUint32(r io.Reader, packetRemaining *int32) uint32 {
+	if *packetRemaining < 4 {
+		raiseError(ErrDataExceedsPacket)
+	}
+
+	var b [4]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		raiseError(err)
+	}
+	*packetRemaining -= 4
+
+	return uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+}
+
+// getVarInt reads an MQTT 5.0 variable byte integer, which is encoded in the
+// same way as the remaining length.
+func getVarInt(r io.Reader, packetRemaining *int32) uint32 {
+	var v uint32
+	for i := uint(0); ; i++ {
+		b := getUint8(r, packetRemaining)
+
+		v |= uint32(b&0x7f) << (7 * i)
+
+		if b&0x80 == 0 {
+			return v
+		}
+		if i == 3 {
+			raiseError(ErrBadLengthEncoding)
+		}
+	}
+}
+
+// getBinary reads MQTT 5.0 binary data, which is encoded in the same way as a
+// string.
+func getBinary(r io.Reader, packetRemaining *int32) []byte {
+	return []byte(getString(r, packetRemaining))
 }
 
 func getString(r io.Reader, packetRemaining *int32) string {
 	strLen := int(getUint16(r, packetRemaining))
 
 	if int(*packetRemaining) < strLen {
-		raiseError(dataExceedsPacketError)
+		raiseError(ErrDataExceedsPacket)
 	}
 
 	b := make([]byte, strLen)
@@ -49,6 +109,33 @@ func getString(r io.Reader, packetRemaining *int32) string {
 	return string(b)
 }
 
+// validateString returns an error if val is too long to be encoded by
+// setString.
+func validateString(val string) error {
+	if len(val) > 0xffff {
+		return ErrStringTooLong
+	}
+	return nil
+}
+
+// validateUTF8String returns an error if val cannot be encoded as an MQTT
+// UTF-8 encoded string. As well as being valid UTF-8, such strings must not
+// contain U+0000 or Unicode non-characters.
+func validateUTF8String(val string) error {
+	if err := validateString(val); err != nil {
+		return err
+	}
+	if !utf8.ValidString(val) {
+		return ErrInvalidString
+	}
+	for _, r := range val {
+		if r == 0 || (r >= 0xfdd0 && r <= 0xfdef) || r&0xfffe == 0xfffe {
+			return ErrInvalidString
+		}
+	}
+	return nil
+}
+
 func setUint8(val uint8, buf *bytes.Buffer) {
 	buf.WriteByte(byte(val))
 }
@@ -58,6 +145,13 @@ func setUint16(val uint16, buf *bytes.Buffer) {
 	buf.WriteByte(byte(val & 0x00ff))
 }
 
+func setUint32(val uint32, buf *bytes.Buffer) {
+	buf.WriteByte(byte(val >> 24))
+	buf.WriteByte(byte(val >> 16))
+	buf.WriteByte(byte(val >> 8))
+	buf.WriteByte(byte(val))
+}
+
 func setString(val string, buf *bytes.Buffer) {
 	length := uint16(len(val))
 	setUint16(length, buf)
@@ -71,26 +165,73 @@ func boolToByte(val bool) byte {
 	return byte(0)
 }
 
+// decodeLength reads a remaining length, raising ErrBadLengthEncoding if the
+// continuation bit is set on its fourth byte. Four bytes carry 28 bits of
+// length, so the result cannot exceed the maximum of 268435455 or overflow.
 func decodeLength(r io.Reader) int32 {
 	var v int32
-	var buf [1]byte
-	var shift uint
-	for i := 0; i < 4; i++ {
-		if _, err := io.ReadFull(r, buf[:]); err != nil {
+	for i := uint(0); ; i++ {
+		b, err := readByte(r)
+		if err != nil {
 			raiseError(err)
 		}
 
-		b := buf[0]
-		v |= int32(b&0x7f) << shift
+		v |= int32(b&0x7f) << (7 * i)
 
 		if b&0x80 == 0 {
 			return v
 		}
+		if i == 3 {
+			raiseError(ErrBadLengthEncoding)
+		}
+	}
+}
+
+// parseLength parses the remaining length from the start of buf, which holds
+// the bytes following the first byte of a fixed header. n is the number of
+// bytes that the encoded length occupies. ok is false if buf ends before the
+// encoded length does, and err is ErrBadLengthEncoding if the encoding
+// exceeds 4 bytes.
+func parseLength(buf []byte) (length int32, n int, ok bool, err error) {
+	var shift uint
+	for i := 0; i < 4; i++ {
+		if i == len(buf) {
+			return 0, 0, false, nil
+		}
+
+		b := buf[i]
+		length |= int32(b&0x7f) << shift
+
+		if b&0x80 == 0 {
+			return length, i + 1, true, nil
+		}
 		shift += 7
 	}
 
-	raiseError(badLengthEncodingError)
-	panic("unreachable")
+	return 0, 0, true, ErrBadLengthEncoding
+}
+
+// encodedLengthSize returns the number of bytes that encodeLength writes for
+// length.
+func encodedLengthSize(length int32) int {
+	n := 1
+	for length > 0x7f {
+		length >>= 7
+		n++
+	}
+	return n
+}
+
+// putLength encodes length into b, which must be encodedLengthSize(length)
+// bytes long.
+func putLength(b []byte, length int32) {
+	for i := range b {
+		b[i] = byte(length & 0x7f)
+		length >>= 7
+		if length > 0 {
+			b[i] |= 0x80
+		}
+	}
 }
 
 func encodeLength(length int32, buf *bytes.Buffer) {
@@ -107,3 +248,15 @@ func encodeLength(length int32, buf *bytes.Buffer) {
 		buf.WriteByte(byte(digit))
 	}
 }
+
+// countingWriter counts the bytes written to an underlying io.Writer.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
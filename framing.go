@@ -0,0 +1,179 @@
+package mqtt
+
+import (
+	"bytes"
+	"io"
+)
+
+// EncodeFramed encodes msg to w, preceded by its encoded length as a
+// big-endian integer of prefixWidth bytes. This supports carrying MQTT over
+// length-delimited transports. prefixWidth must be 1, 2 or 4, and
+// ErrFrameTooLong is returned without writing anything if the encoded
+// message length cannot be represented in prefixWidth bytes.
+func EncodeFramed(w io.Writer, msg Message, prefixWidth int) error {
+	var maxLength int64
+	switch prefixWidth {
+	case 1, 2, 4:
+		maxLength = 1<<(8*uint(prefixWidth)) - 1
+	default:
+		return ErrBadFramePrefixWidth
+	}
+
+	buf := new(bytes.Buffer)
+	if err := msg.Encode(buf); err != nil {
+		return err
+	}
+	length := int64(buf.Len())
+	if length > maxLength {
+		return ErrFrameTooLong
+	}
+
+	frame := make([]byte, prefixWidth, prefixWidth+buf.Len())
+	for i := range frame {
+		frame[i] = byte(length >> (8 * uint(prefixWidth-1-i)))
+	}
+	frame = append(frame, buf.Bytes()...)
+	_, err := w.Write(frame)
+	return err
+}
+
+// BytesNeeded returns the number of bytes that must be appended to buffered,
+// which holds the start of an encoded message, for it to contain the complete
+// message. This allows a reader to read exactly the rest of a message with
+// one call. known is false if buffered does not yet contain the whole fixed
+// header, in which case n is 1 to hint that at least one more byte is needed. n
+// is 0 if buffered already contains the complete message, or if its remaining
+// length is invalid such that decoding it will fail.
+func BytesNeeded(buffered []byte) (n int, known bool) {
+	size, known, err := packetSize(buffered)
+	if !known {
+		return 1, false
+	}
+	if err != nil {
+		return 0, true
+	}
+	if n = size - len(buffered); n < 0 {
+		n = 0
+	}
+	return n, true
+}
+
+// IsComplete returns true if b begins with a complete encoded message. size is
+// the total length of the message, or 0 if b does not yet contain its whole
+// fixed header. ErrBadLengthEncoding is returned if the remaining length is
+// invalid.
+func IsComplete(b []byte) (complete bool, size int, err error) {
+	size, known, err := packetSize(b)
+	if !known || err != nil {
+		return false, 0, err
+	}
+	return len(b) >= size, size, nil
+}
+
+// packetSize returns the total length of the message whose encoding begins
+// buffered. known is false if buffered does not contain the whole fixed
+// header.
+func packetSize(buffered []byte) (size int, known bool, err error) {
+	if len(buffered) == 0 {
+		return 0, false, nil
+	}
+	length, lengthSize, ok, err := parseLength(buffered[1:])
+	if !ok || err != nil {
+		return 0, ok, err
+	}
+	return 1 + lengthSize + int(length), true, nil
+}
+
+// DecodeFrame decodes frame, which must hold exactly one encoded message, as
+// each binary frame of MQTT over WebSockets does. ErrIncompletePacket is
+// returned if frame ends before the message does, and ErrTrailingBytes if it
+// continues after it. config is treated as for DecodeOneMessage.
+func DecodeFrame(frame []byte, config DecoderConfig) (Message, error) {
+	complete, size, err := IsComplete(frame)
+	if err != nil {
+		return nil, err
+	}
+	if !complete {
+		return nil, ErrIncompletePacket
+	}
+	if size < len(frame) {
+		return nil, ErrTrailingBytes
+	}
+	return DecodeOneMessage(bytes.NewReader(frame), config)
+}
+
+// PacketScanner buffers encoded messages that arrive in arbitrary pieces, such
+// as from a non-blocking reader, and decodes each one once it is complete.
+// The zero value is ready to use.
+type PacketScanner struct {
+	// Config is the DecoderConfig used to decode messages, nil indicates that
+	// the DefaultDecoderConfig should be used.
+	Config DecoderConfig
+
+	buf []byte
+}
+
+// Feed buffers bytes from the start of b, up to the end of the current
+// message. complete is true once the message is complete, and consumed is the
+// number of bytes of b that were buffered; any bytes after consumed belong to
+// following messages, and should be fed after Packet has been called. complete
+// is also true if the remaining length is invalid, or is greater than the
+// MaxRemainingLength of Config, so that Packet returns the error. The body of
+// a message that is too large is not buffered.
+func (s *PacketScanner) Feed(b []byte) (complete bool, consumed int) {
+	for {
+		size, known, err := packetSize(s.buf)
+		if err != nil || (known && (len(s.buf) >= size || s.tooLarge())) {
+			return true, consumed
+		}
+		if consumed == len(b) {
+			return false, consumed
+		}
+
+		// Until the remaining length is known, buffer one byte at a time so as
+		// not to read past the message.
+		n := 1
+		if known {
+			n = size - len(s.buf)
+			if n > len(b)-consumed {
+				n = len(b) - consumed
+			}
+		}
+		s.buf = append(s.buf, b[consumed:consumed+n]...)
+		consumed += n
+	}
+}
+
+// Packet decodes the message that Feed has reported as complete, and clears
+// the buffer for the next message. ErrIncompletePacket is returned if the
+// buffered message is not complete. ErrPacketTooLarge is returned if the
+// message is larger than the MaxRemainingLength of Config, in which case its
+// body has not been fed, and the stream it was read from should be closed.
+func (s *PacketScanner) Packet() (Message, error) {
+	if s.tooLarge() {
+		s.buf = s.buf[:0]
+		return nil, ErrPacketTooLarge
+	}
+	complete, _, err := IsComplete(s.buf)
+	if err == nil && !complete {
+		return nil, ErrIncompletePacket
+	}
+	defer func() {
+		s.buf = s.buf[:0]
+	}()
+	if err != nil {
+		return nil, err
+	}
+	return DecodeOneMessage(bytes.NewReader(s.buf), s.Config)
+}
+
+// tooLarge returns true if the buffered fixed header has a remaining length
+// greater than the MaxRemainingLength of Config.
+func (s *PacketScanner) tooLarge() bool {
+	max := decodeOptions(s.Config).MaxRemainingLength
+	if max == 0 || len(s.buf) == 0 {
+		return false
+	}
+	length, _, ok, err := parseLength(s.buf[1:])
+	return ok && err == nil && length > max
+}
@@ -0,0 +1,402 @@
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// AutoRespond returns a plausible successful response to msg, as a broker (or
+// client, in the case of QoS 2 acknowledgements) would send it. ok is false if
+// msg warrants no response. This is intended for writing fake brokers in
+// tests, and does not implement any authorization or session state:
+//
+// * CONNECT is accepted.
+//
+// * PUBLISH is acknowledged with PUBACK or PUBREC according to its QoS.
+//
+// * PUBREC and PUBREL continue the QoS 2 flow with PUBREL and PUBCOMP.
+//
+// * SUBSCRIBE is granted the QoS requested for each topic.
+//
+// * UNSUBSCRIBE is acknowledged and PINGREQ is answered with PINGRESP.
+func AutoRespond(msg Message) (resp Message, ok bool) {
+	switch msg := msg.(type) {
+	case *Connect:
+		return &ConnAck{ReturnCode: RetCodeAccepted}, true
+	case *Publish:
+		switch msg.Header.QosLevel {
+		case QosAtLeastOnce:
+			return NewPubAck(msg.MessageId), true
+		case QosExactlyOnce:
+			return NewPubRec(msg.MessageId), true
+		}
+	case *PubRec:
+		return NewPubRel(msg.MessageId), true
+	case *PubRel:
+		return NewPubComp(msg.MessageId), true
+	case *Subscribe:
+		granted := make([]QosLevel, len(msg.Topics))
+		for i, topic := range msg.Topics {
+			granted[i] = topic.Qos
+		}
+		return &SubAck{MessageId: msg.MessageId, TopicsQos: granted}, true
+	case *Unsubscribe:
+		return NewUnsubAck(msg.MessageId), true
+	case *PingReq:
+		return &PingResp{}, true
+	}
+	return nil, false
+}
+
+// SubscriptionOptions holds the MQTT 5.0 options of a subscription, other
+// than its maximum QoS.
+type SubscriptionOptions struct {
+	// NoLocal is set if messages must not be forwarded to the client that
+	// published them.
+	NoLocal bool
+	// RetainAsPublished is set if forwarded messages keep the RETAIN flag
+	// that they were published with, rather than having it cleared.
+	RetainAsPublished bool
+	// RetainHandling controls whether retained messages are sent when the
+	// subscription is made.
+	RetainHandling RetainHandling
+}
+
+// RetainHandling is the MQTT 5.0 Retain Handling subscription option.
+type RetainHandling uint8
+
+const (
+	// RetainSendOnSubscribe sends retained messages whenever the
+	// subscription is made.
+	RetainSendOnSubscribe = RetainHandling(iota)
+	// RetainSendIfNew sends retained messages only if the subscription did
+	// not already exist.
+	RetainSendIfNew
+	// RetainDoNotSend never sends retained messages for the subscription.
+	RetainDoNotSend
+)
+
+// ShouldDeliverNoLocal returns false if a PUBLISH from the client
+// publisherClientId must not be forwarded to the subscription of
+// subscriberClientId because of its No Local option, which is the case when
+// NoLocal is set and the two clients are the same.
+func ShouldDeliverNoLocal(opts SubscriptionOptions, publisherClientId, subscriberClientId string) bool {
+	return !opts.NoLocal || publisherClientId != subscriberClientId
+}
+
+// sharedSubscriptionPrefix begins the topic filter of an MQTT 5.0 shared
+// subscription, which has the form "$share/{ShareName}/{filter}".
+const sharedSubscriptionPrefix = "$share/"
+
+// ValidateForFilter checks that o may be requested in an MQTT 5.0 SUBSCRIBE
+// for filter. It returns ErrBadRetainHandling for a Retain Handling value
+// other than 0, 1 or 2, ErrBadSharedSubscription for a shared subscription
+// filter with an empty ShareName, a ShareName containing a wildcard or no
+// topic filter after the ShareName, and ErrNoLocalOnShared if NoLocal is set
+// on a shared subscription.
+func (o SubscriptionOptions) ValidateForFilter(filter string) error {
+	if o.RetainHandling > RetainDoNotSend {
+		return ErrBadRetainHandling
+	}
+	if !strings.HasPrefix(filter, sharedSubscriptionPrefix) {
+		return nil
+	}
+	shareName, shared, ok := strings.Cut(filter[len(sharedSubscriptionPrefix):], "/")
+	if !ok || shareName == "" || strings.ContainsAny(shareName, "+#") || shared == "" {
+		return ErrBadSharedSubscription
+	}
+	if o.NoLocal {
+		return ErrNoLocalOnShared
+	}
+	return nil
+}
+
+// ExpectsResponse returns the type of message that the receiver of msg is
+// expected to respond with, and whether a response is expected at all.
+func ExpectsResponse(msg Message) (MessageType, bool) {
+	switch msg := msg.(type) {
+	case *Connect:
+		return MsgConnAck, true
+	case *Publish:
+		switch msg.Header.QosLevel {
+		case QosAtLeastOnce:
+			return MsgPubAck, true
+		case QosExactlyOnce:
+			return MsgPubRec, true
+		}
+	case *PubRec:
+		return MsgPubRel, true
+	case *PubRel:
+		return MsgPubComp, true
+	case *Subscribe:
+		return MsgSubAck, true
+	case *Unsubscribe:
+		return MsgUnsubAck, true
+	case *PingReq:
+		return MsgPingResp, true
+	}
+	return 0, false
+}
+
+// Retransmittable returns true if msg may be resent as part of the QoS
+// delivery flow when its acknowledgement has not been received: a PUBLISH of
+// QoS 1 or 2 (which should be resent with DupFlag set), or the PUBREC and
+// PUBREL of the QoS 2 flow. Other messages, such as CONNECT or SUBSCRIBE, must
+// not be resent this way.
+func Retransmittable(msg Message) bool {
+	switch msg := msg.(type) {
+	case *Publish:
+		return msg.Header.QosLevel.HasId()
+	case *PubRec, *PubRel:
+		return true
+	}
+	return false
+}
+
+// ExceedsMaxQoS returns true if msg is a PUBLISH whose QoS level is greater
+// than maxQos, or a SUBSCRIBE requesting a QoS level greater than maxQos for
+// any of its topic filters. This allows a client to check messages against the
+// maximum QoS level supported by a server.
+func ExceedsMaxQoS(msg Message, maxQos QosLevel) bool {
+	switch msg := msg.(type) {
+	case *Publish:
+		return msg.Header.QosLevel > maxQos
+	case *Subscribe:
+		for _, topic := range msg.Topics {
+			if topic.Qos > maxQos {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// KeepAliveExpired returns true if more than one and a half times the keep
+// alive interval of a connection, in seconds (as in Connect.KeepAliveTimer),
+// has passed between lastReceived and now. A server should disconnect a
+// client that has sent no message in this time. A keepAlive of 0 disables the
+// keep alive mechanism, and never expires.
+func KeepAliveExpired(keepAlive uint16, lastReceived, now time.Time) bool {
+	if keepAlive == 0 {
+		return false
+	}
+	return now.Sub(lastReceived) > time.Duration(keepAlive)*1500*time.Millisecond
+}
+
+// ValidMessageId returns false if msg requires a message ID, but its MessageId
+// is the reserved value 0. This is the case for PUBLISH messages of QoS 1 or 2,
+// and for the other message types that carry a message ID. Encoding such a
+// message fails with ErrMissingMessageId.
+func ValidMessageId(msg Message) bool {
+	id := messageIdPtr(msg)
+	return id == nil || *id != 0
+}
+
+// messageIdPtr returns a pointer to the MessageId field of msg, or nil if msg
+// does not carry a message ID, including a PUBLISH of QoS 0.
+func messageIdPtr(msg Message) *uint16 {
+	switch msg := msg.(type) {
+	case *Publish:
+		if msg.Header.QosLevel.HasId() {
+			return &msg.MessageId
+		}
+	case *PubAck:
+		return &msg.MessageId
+	case *PubRec:
+		return &msg.MessageId
+	case *PubRel:
+		return &msg.MessageId
+	case *PubComp:
+		return &msg.MessageId
+	case *Subscribe:
+		return &msg.MessageId
+	case *SubAck:
+		return &msg.MessageId
+	case *Unsubscribe:
+		return &msg.MessageId
+	case *UnsubAck:
+		return &msg.MessageId
+	}
+	return nil
+}
+
+// WithMessageId returns a copy of msg with its MessageId replaced by id, for
+// remapping message IDs between connections. The copy is shallow, so it
+// shares any payload or topic slices with msg. ErrNoMessageId is returned if
+// msg does not carry a message ID, including a PUBLISH of QoS 0.
+func WithMessageId(msg Message, id uint16) (Message, error) {
+	if messageIdPtr(msg) == nil {
+		return nil, ErrNoMessageId
+	}
+	var clone Message
+	switch msg := msg.(type) {
+	case *Publish:
+		c := *msg
+		clone = &c
+	case *PubAck:
+		c := *msg
+		clone = &c
+	case *PubRec:
+		c := *msg
+		clone = &c
+	case *PubRel:
+		c := *msg
+		clone = &c
+	case *PubComp:
+		c := *msg
+		clone = &c
+	case *Subscribe:
+		c := *msg
+		clone = &c
+	case *SubAck:
+		c := *msg
+		clone = &c
+	case *Unsubscribe:
+		c := *msg
+		clone = &c
+	case *UnsubAck:
+		c := *msg
+		clone = &c
+	}
+	*messageIdPtr(clone) = id
+	return clone, nil
+}
+
+// ValidateHandshake checks that a recorded sequence of messages on a
+// connection (in both directions) begins with the connection prologue: a
+// CONNECT, immediately followed by a CONNACK with a valid return code. No
+// further messages may follow a CONNACK that refuses the connection, and
+// CONNECT may not be sent again. The returned error wraps ErrBadHandshake and
+// identifies the first violation.
+func ValidateHandshake(msgs []Message) error {
+	if len(msgs) == 0 {
+		return fmt.Errorf("%w: expected CONNECT, got no messages", ErrBadHandshake)
+	}
+	if _, ok := msgs[0].(*Connect); !ok {
+		return fmt.Errorf("%w: message 0: expected CONNECT, got %T", ErrBadHandshake, msgs[0])
+	}
+	if len(msgs) == 1 {
+		return fmt.Errorf("%w: expected CONNACK after CONNECT, got no more messages", ErrBadHandshake)
+	}
+	connAck, ok := msgs[1].(*ConnAck)
+	if !ok {
+		return fmt.Errorf("%w: message 1: expected CONNACK, got %T", ErrBadHandshake, msgs[1])
+	}
+	if !connAck.ReturnCode.IsValid() {
+		return fmt.Errorf("%w: message 1: CONNACK return code %d is invalid", ErrBadHandshake, connAck.ReturnCode)
+	}
+	if connAck.ReturnCode != RetCodeAccepted && len(msgs) > 2 {
+		return fmt.Errorf("%w: message 2: %T follows CONNACK refusing the connection", ErrBadHandshake, msgs[2])
+	}
+	for i, msg := range msgs[2:] {
+		if _, ok := msg.(*Connect); ok {
+			return fmt.Errorf("%w: message %d: CONNECT sent more than once", ErrBadHandshake, i+2)
+		}
+	}
+	return nil
+}
+
+// SubscriptionDiff compares the topic filters of two SUBSCRIBE messages,
+// returning the filters that are only in next, the filters that are only in
+// prev, and the filters in both whose requested QoS differs. Filters are
+// returned in the order that they appear in next, or in prev for removed. If a
+// filter appears more than once in a message, its last QoS is used.
+func SubscriptionDiff(prev, next *Subscribe) (added, removed, changedQos []string) {
+	prevQos := qosByTopic(prev.Topics)
+	nextQos := qosByTopic(next.Topics)
+
+	seen := make(map[string]bool, len(next.Topics))
+	for _, topic := range next.Topics {
+		if seen[topic.Topic] {
+			continue
+		}
+		seen[topic.Topic] = true
+		if qos, ok := prevQos[topic.Topic]; !ok {
+			added = append(added, topic.Topic)
+		} else if qos != nextQos[topic.Topic] {
+			changedQos = append(changedQos, topic.Topic)
+		}
+	}
+
+	seen = make(map[string]bool, len(prev.Topics))
+	for _, topic := range prev.Topics {
+		if seen[topic.Topic] {
+			continue
+		}
+		seen[topic.Topic] = true
+		if _, ok := nextQos[topic.Topic]; !ok {
+			removed = append(removed, topic.Topic)
+		}
+	}
+	return added, removed, changedQos
+}
+
+// qosByTopic maps each topic filter in topics to its requested QoS.
+func qosByTopic(topics []TopicQos) map[string]QosLevel {
+	qos := make(map[string]QosLevel, len(topics))
+	for _, topic := range topics {
+		qos[topic.Topic] = topic.Qos
+	}
+	return qos
+}
+
+// DisconnectForError returns the MQTT 5.0 DISCONNECT that a server sends
+// before closing a connection because of err, as returned when decoding or
+// validating a message. The reason code is:
+//
+// * Malformed Packet (0x81) for errors in the encoding of a message.
+//
+// * Protocol Error (0x82) for well formed messages that are not allowed, such
+// as a message of an unexpected type.
+//
+// * Packet Too Large (0x95) for ErrPacketTooLarge.
+//
+// * Keep Alive Timeout (0x8D) for ErrPacketTimeout.
+//
+// * Unspecified Error (0x80) otherwise.
+//
+// The Reason String is set to the error message. If err is nil, a normal
+// disconnection with no Reason String is returned.
+func DisconnectForError(err error) *Disconnect {
+	if err == nil {
+		return &Disconnect{ProtocolVersion: 5}
+	}
+	return &Disconnect{ProtocolVersion: 5, ReasonCode: reasonCodeForError(err), ReasonString: err.Error()}
+}
+
+// reasonCodeForError returns the DISCONNECT reason code for err.
+func reasonCodeForError(err error) ReasonCode {
+	switch {
+	case errors.Is(err, ErrPacketTooLarge):
+		return ReasonPacketTooLarge
+	case errors.Is(err, ErrPacketTimeout):
+		return ReasonKeepAliveTimeout
+	case errors.Is(err, ErrTooManyTopics):
+		return ReasonQuotaExceeded
+	case errors.Is(err, ErrInvalidTopicFilter):
+		return ReasonTopicFilterInvalid
+	case errors.Is(err, ErrInvalidTopicName):
+		return ReasonTopicNameInvalid
+	case errors.Is(err, ErrInternal):
+		return ReasonImplementationError
+	}
+
+	for _, target := range []error{ErrBadMsgType, ErrBadQos, ErrBadWillQos, ErrBadLengthEncoding,
+		ErrBadReturnCode, ErrDataExceedsPacket, ErrConnectPayloadMismatch, ErrInvalidFixedHeaderFlags,
+		ErrTrailingBytes, ErrDupOnQos0, ErrStringTooLong, ErrInvalidString, ErrReservedFlagSet,
+		ErrMissingMessageId, ErrWillWithoutFlag, ErrPasswordWithoutUsername, ErrBadProperty,
+		ErrTruncatedPublish, io.ErrUnexpectedEOF} {
+		if errors.Is(err, target) {
+			return ReasonMalformedPacket
+		}
+	}
+	for _, target := range []error{ErrUnexpectedMsgType, ErrProtocolMismatch, ErrBadHandshake} {
+		if errors.Is(err, target) {
+			return ReasonProtocolError
+		}
+	}
+	return ReasonUnspecifiedError
+}
@@ -28,34 +28,60 @@ func (hdr *Header) Encode(w io.Writer, msgType MessageType, remainingLength int3
 }
 
 func (hdr *Header) encodeInto(buf *bytes.Buffer, msgType MessageType, remainingLength int32) error {
-	if !hdr.QosLevel.IsValid() {
-		return badQosError
-	}
-	if !msgType.IsValid() {
-		return badMsgTypeError
+	if err := hdr.validate(msgType); err != nil {
+		return err
 	}
 
-	val := byte(msgType) << 4
-	val |= (boolToByte(hdr.DupFlag) << 3)
-	val |= byte(hdr.QosLevel) << 1
-	val |= boolToByte(hdr.Retain)
-	buf.WriteByte(val)
+	buf.WriteByte(byte(msgType)<<4 | hdr.flags())
 	encodeLength(remainingLength, buf)
 	return nil
 }
 
+// validate returns an error if hdr cannot be encoded for a message of type
+// msgType.
+func (hdr *Header) validate(msgType MessageType) error {
+	if !hdr.QosLevel.IsValid() {
+		return ErrBadQos
+	}
+	if !msgType.IsValid() && registeredMessage(msgType) == nil {
+		return ErrBadMsgType
+	}
+	if !msgType.validFixedHeaderFlags(hdr.flags(), false) {
+		return ErrInvalidFixedHeaderFlags
+	}
+	return nil
+}
+
+// flags returns the DUP, QoS and RETAIN bits of the fixed header byte.
+func (hdr *Header) flags() byte {
+	flags := boolToByte(hdr.DupFlag) << 3
+	flags |= byte(hdr.QosLevel) << 1
+	flags |= boolToByte(hdr.Retain)
+	return flags
+}
+
+// IsRetransmit returns true if the header marks a message as a possible
+// redelivery of an earlier attempt to send it.
+func (hdr *Header) IsRetransmit() bool {
+	return hdr.DupFlag && hdr.QosLevel.HasId()
+}
+
+// Decode reads only the fixed header of a message from r into hdr, returning
+// the message type and remaining length, and leaves the body unread in r. This
+// allows a message to be routed by its type without decoding its body, which
+// can then be read as the next remainingLength bytes of r. If the QoS bits are
+// invalid, ErrBadQos is returned along with the message type and remaining
+// length, so that the body can still be skipped.
 func (hdr *Header) Decode(r io.Reader) (msgType MessageType, remainingLength int32, err error) {
 	defer func() {
 		err = recoverError(err, recover())
 	}()
 
-	var buf [1]byte
-
-	if _, err = io.ReadFull(r, buf[:]); err != nil {
+	var byte1 byte
+	if byte1, err = readByte(r); err != nil {
 		return
 	}
 
-	byte1 := buf[0]
 	msgType = MessageType(byte1 & 0xF0 >> 4)
 
 	*hdr = Header{
@@ -66,6 +92,10 @@ func (hdr *Header) Decode(r io.Reader) (msgType MessageType, remainingLength int
 
 	remainingLength = decodeLength(r)
 
+	if !hdr.QosLevel.IsValid() {
+		err = ErrBadQos
+	}
+
 	return
 }
 
@@ -76,10 +106,42 @@ type Message interface {
 
 	// Decode reads the message extended headers and payload from
 	// r. Typically the values for hdr and packetRemaining will
-	// be returned from Header.Decode.
+	// be returned from Header.Decode. Errors are returned as *DecodeError.
 	Decode(r io.Reader, hdr Header, packetRemaining int32, config DecoderConfig) error
 }
 
+// The following interfaces are optionally implemented by a Message, and are
+// implemented by all of the message types of this package, as is io.WriterTo
+// (writing the message in the same way as Encode).
+
+// Resetter is implemented by messages that can be reset for reuse.
+// DecodeInto resets messages that implement it before decoding into them.
+type Resetter interface {
+	// Reset sets the message to its zero value, keeping the capacity of any
+	// slices so that the message can be reused for decoding.
+	Reset()
+}
+
+// Sizer is implemented by messages that can report their encoded size.
+type Sizer interface {
+	// EncodedLen returns the number of bytes that Encode would write, or the
+	// error that Encode would return. The payload of a Publish message is not
+	// written in order to determine this.
+	EncodedLen() (int, error)
+}
+
+// Validate returns the error that Encode would return for msg, without
+// encoding it. It checks the fields of the message and their combination, such
+// as a QoS level requiring a MessageId. Messages that do not implement Sizer
+// are encoded to io.Discard in order to check them.
+func Validate(msg Message) error {
+	if s, ok := msg.(Sizer); ok {
+		_, err := s.EncodedLen()
+		return err
+	}
+	return msg.Encode(io.Discard)
+}
+
 // MessageType constants.
 const (
 	MsgConnect = MessageType(iota + 1)
@@ -107,25 +169,128 @@ func (mt MessageType) IsValid() bool {
 	return mt >= MsgConnect && mt < msgTypeFirstInvalid
 }
 
+// IsAck returns true if the message type acknowledges another message.
+func (mt MessageType) IsAck() bool {
+	switch mt {
+	case MsgConnAck, MsgPubAck, MsgPubRec, MsgPubRel, MsgPubComp, MsgSubAck, MsgUnsubAck:
+		return true
+	}
+	return false
+}
+
+// CarriesMessageId returns true if messages of the type can contain a
+// MessageId. PUBLISH messages only contain one when their QoS level has an id.
+func (mt MessageType) CarriesMessageId() bool {
+	switch mt {
+	case MsgPublish, MsgPubAck, MsgPubRec, MsgPubRel, MsgPubComp,
+		MsgSubscribe, MsgSubAck, MsgUnsubscribe, MsgUnsubAck:
+		return true
+	}
+	return false
+}
+
+// HasTopicList returns true if messages of the type contain a list of topics.
+func (mt MessageType) HasTopicList() bool {
+	return mt == MsgSubscribe || mt == MsgUnsubscribe
+}
+
+// decodesVersion5 returns true if messages of the type can be decoded when
+// DecodeOptions.ProtocolVersion is 5 or greater. Types registered with
+// RegisterMessage decode for any version.
+func (mt MessageType) decodesVersion5() bool {
+	switch mt {
+	case MsgConnect, MsgConnAck, MsgPublish, MsgPubAck, MsgPubRec, MsgPubRel, MsgPubComp,
+		MsgPingReq, MsgPingResp, MsgDisconnect:
+		return true
+	}
+	return !mt.IsValid() && registeredMessage(mt) != nil
+}
+
+// fixedHeaderFlags returns the value that the DUP, QoS and RETAIN bits of the
+// fixed header must take for the message type. fixed is false if the message
+// type permits any value, which is only the case for PUBLISH and types
+// registered with RegisterMessage.
+func (mt MessageType) fixedHeaderFlags() (flags byte, fixed bool) {
+	switch mt {
+	case MsgPublish:
+		return 0, false
+	case MsgPubRel, MsgSubscribe, MsgUnsubscribe:
+		return 0x02, true
+	}
+	if !mt.IsValid() && registeredMessage(mt) != nil {
+		return 0, false
+	}
+	return 0, true
+}
+
+// validFixedHeaderFlags returns true if flags, the DUP, QoS and RETAIN bits of
+// a fixed header, are valid for the message type. MQTT 3.1 allows DUP to be set
+// on PUBREL, SUBSCRIBE and UNSUBSCRIBE, so unless strict is true, DUP is
+// ignored for those types.
+func (mt MessageType) validFixedHeaderFlags(flags byte, strict bool) bool {
+	required, fixed := mt.fixedHeaderFlags()
+	if !fixed {
+		return true
+	}
+	if !strict && (mt == MsgPubRel || mt == MsgSubscribe || mt == MsgUnsubscribe) {
+		flags &^= 0x08
+	}
+	return flags == required
+}
+
+// encodedLen returns the encoded size of a message with the given header and
+// remaining length, checking it in the same way as writeMessage.
+func encodedLen(hdr *Header, msgType MessageType, remainingLength int64) (int, error) {
+	if remainingLength > MaxPayloadSize {
+		return 0, ErrMsgTooLong
+	}
+	if err := hdr.validate(msgType); err != nil {
+		return 0, err
+	}
+	return 1 + encodedLengthSize(int32(remainingLength)) + int(remainingLength), nil
+}
+
+// maxHeaderLen is the largest encoded length of a fixed header.
+const maxHeaderLen = 5
+
+// newMessageBuffer returns a buffer for writing a message body of bodyLen
+// bytes to, which is passed to writeMessage. Space is reserved at the start of
+// the buffer for the fixed header, so that the message can be written without
+// copying it to another buffer.
+func newMessageBuffer(bodyLen int) *bytes.Buffer {
+	return bytes.NewBuffer(make([]byte, maxHeaderLen, maxHeaderLen+bodyLen))
+}
+
+// writeMessage writes the fixed header followed by the body in payloadBuf,
+// which must have been created by newMessageBuffer. extraLength is the length
+// of any payload that follows, which the caller writes.
 func writeMessage(w io.Writer, msgType MessageType, hdr *Header, payloadBuf *bytes.Buffer, extraLength int32) error {
-	totalPayloadLength := int64(len(payloadBuf.Bytes())) + int64(extraLength)
+	body := payloadBuf.Bytes()[maxHeaderLen:]
+	totalPayloadLength := int64(len(body)) + int64(extraLength)
 	if totalPayloadLength > MaxPayloadSize {
-		return msgTooLongError
+		return ErrMsgTooLong
 	}
 
-	buf := new(bytes.Buffer)
-	err := hdr.encodeInto(buf, msgType, int32(totalPayloadLength))
-	if err != nil {
+	if err := hdr.validate(msgType); err != nil {
 		return err
 	}
 
-	buf.Write(payloadBuf.Bytes())
-	_, err = w.Write(buf.Bytes())
+	// Write the fixed header immediately before the body.
+	hdrLen := 1 + encodedLengthSize(int32(totalPayloadLength))
+	msg := payloadBuf.Bytes()[maxHeaderLen-hdrLen:]
+	msg[0] = byte(msgType)<<4 | hdr.flags()
+	putLength(msg[1:hdrLen], int32(totalPayloadLength))
+	_, err := w.Write(msg)
 
 	return err
 }
 
 // Connect represents an MQTT CONNECT message.
+//
+// WillMessage, the will payload, and Password are binary data rather than
+// text. They are held in strings, since a Go string may contain arbitrary
+// bytes, and are not validated as UTF-8 when encoding or decoding. Will and
+// Credentials return them as a []byte.
 type Connect struct {
 	Header
 	ProtocolName               string
@@ -139,14 +304,50 @@ type Connect struct {
 	WillTopic, WillMessage     string
 	UsernameFlag, PasswordFlag bool
 	Username, Password         string
+
+	// SessionExpiryInterval is the MQTT 5.0 Session Expiry Interval property
+	// in seconds, or nil if absent. It may only be set when ProtocolVersion is
+	// 5 or greater. The other CONNECT properties are checked and then skipped
+	// when decoding, and are not encoded.
+	SessionExpiryInterval *uint32
+	// WillProperties holds the MQTT 5.0 will properties that are carried by
+	// the will PUBLISH, and WillDelayInterval the Will Delay Interval in
+	// seconds. Both are nil if absent, and may only be set when WillFlag is
+	// set and ProtocolVersion is 5 or greater. WillProperties may not contain
+	// a TopicAlias or SubscriptionIdentifiers.
+	WillProperties    *Properties
+	WillDelayInterval *uint32
+
+	// FieldSpans records where the payload strings were found in the encoded
+	// message. It is only set when decoding with
+	// DecodeOptions.RecordConnectSpans, and is ignored when encoding.
+	FieldSpans *ConnectFieldSpans
+}
+
+// FieldSpan locates a field within an encoded message. Offset is relative to
+// the first byte of the fixed header. For string fields the span includes the
+// two byte length prefix, so that a replacement string can be spliced into the
+// message in its encoded form (along with updating the remaining length).
+type FieldSpan struct {
+	Offset, Length int
+}
+
+// ConnectFieldSpans locates the CONNECT payload strings. Spans are zero for
+// fields that were not present.
+type ConnectFieldSpans struct {
+	ClientId, WillTopic, WillMessage, Username, Password FieldSpan
 }
 
 func (msg *Connect) Encode(w io.Writer) (err error) {
-	if !msg.WillQos.IsValid() {
-		return badWillQosError
+	if err = msg.validate(); err != nil {
+		return
 	}
 
-	buf := new(bytes.Buffer)
+	// The protocol name, version, flags and keep alive, followed by the payload
+	// strings.
+	bodyLen := 6 + len(msg.ProtocolName) + 10 + len(msg.ClientId) + len(msg.WillTopic) +
+		len(msg.WillMessage) + len(msg.Username) + len(msg.Password)
+	buf := newMessageBuffer(bodyLen)
 
 	flags := boolToByte(msg.UsernameFlag) << 7
 	flags |= boolToByte(msg.PasswordFlag) << 6
@@ -159,8 +360,20 @@ func (msg *Connect) Encode(w io.Writer) (err error) {
 	setUint8(msg.ProtocolVersion, buf)
 	buf.WriteByte(flags)
 	setUint16(msg.KeepAliveTimer, buf)
+	if msg.ProtocolVersion >= 5 {
+		if msg.SessionExpiryInterval != nil {
+			encodeLength(5, buf)
+			setUint8(propSessionExpiryInterval, buf)
+			setUint32(*msg.SessionExpiryInterval, buf)
+		} else {
+			encodeLength(0, buf)
+		}
+	}
 	setString(msg.ClientId, buf)
 	if msg.WillFlag {
+		if msg.ProtocolVersion >= 5 {
+			msg.encodeWillProperties(buf)
+		}
 		setString(msg.WillTopic, buf)
 		setString(msg.WillMessage, buf)
 	}
@@ -174,20 +387,98 @@ func (msg *Connect) Encode(w io.Writer) (err error) {
 	return writeMessage(w, MsgConnect, &msg.Header, buf, 0)
 }
 
+func (msg *Connect) WriteTo(w io.Writer) (int64, error) {
+	return writeTo(w, msg)
+}
+
+func (msg *Connect) EncodedLen() (int, error) {
+	if err := msg.validate(); err != nil {
+		return 0, err
+	}
+
+	length := 2 + len(msg.ProtocolName) + 1 + 1 + 2 + 2 + len(msg.ClientId)
+	if msg.ProtocolVersion >= 5 {
+		length++
+		if msg.SessionExpiryInterval != nil {
+			length += 5
+		}
+	}
+	if msg.WillFlag {
+		length += 2 + len(msg.WillTopic) + 2 + len(msg.WillMessage)
+		if msg.ProtocolVersion >= 5 {
+			size := msg.willPropertiesSize()
+			length += encodedLengthSize(int32(size)) + int(size)
+		}
+	}
+	if msg.UsernameFlag {
+		length += 2 + len(msg.Username)
+	}
+	if msg.PasswordFlag {
+		length += 2 + len(msg.Password)
+	}
+
+	return encodedLen(&msg.Header, MsgConnect, int64(length))
+}
+
+// willPropertiesSize returns the encoded size of the will properties,
+// excluding the property length.
+func (msg *Connect) willPropertiesSize() int64 {
+	var size int64
+	if msg.WillDelayInterval != nil {
+		size += 5
+	}
+	if msg.WillProperties != nil {
+		size += msg.WillProperties.size()
+	}
+	return size
+}
+
+// encodeWillProperties writes the property length followed by the will
+// properties to buf.
+func (msg *Connect) encodeWillProperties(buf *bytes.Buffer) {
+	encodeLength(int32(msg.willPropertiesSize()), buf)
+	if msg.WillDelayInterval != nil {
+		setUint8(propWillDelayInterval, buf)
+		setUint32(*msg.WillDelayInterval, buf)
+	}
+	if msg.WillProperties != nil {
+		msg.WillProperties.encodeProperties(buf)
+	}
+}
+
 func (msg *Connect) Decode(r io.Reader, hdr Header, packetRemaining int32, config DecoderConfig) (err error) {
+	bodyLen := packetRemaining
 	defer func() {
-		err = recoverError(err, recover())
+		err = decodeError(recoverError(err, recover()), bodyLen, packetRemaining)
 	}()
 
 	msg.Header = hdr
 
+	// spanned reads a string using get, recording its FieldSpan in span.
+	var spans ConnectFieldSpans
+	headerLength := 1 + encodedLengthSize(bodyLen)
+	spanned := func(span *FieldSpan, get func(io.Reader, *int32) string) string {
+		start := headerLength + int(bodyLen-packetRemaining)
+		val := get(r, &packetRemaining)
+		*span = FieldSpan{start, headerLength + int(bodyLen-packetRemaining) - start}
+		return val
+	}
+
 	protocolName := getString(r, &packetRemaining)
 	protocolVersion := getUint8(r, &packetRemaining)
 	flags := getUint8(r, &packetRemaining)
+	if flags&0x01 != 0 && decodeOptions(config).Strict {
+		return ErrReservedFlagSet
+	}
 	keepAliveTimer := getUint16(r, &packetRemaining)
-	clientId := getString(r, &packetRemaining)
+	var sessionExpiry *uint32
+	if protocolVersion >= 5 {
+		sessionExpiry = getConnectProperties(r, &packetRemaining)
+	}
+	clientId := spanned(&spans.ClientId, getString)
 
 	*msg = Connect{
+		Header:          hdr,
 		ProtocolName:    protocolName,
 		ProtocolVersion: protocolVersion,
 		UsernameFlag:    flags&0x80 > 0,
@@ -198,163 +489,721 @@ func (msg *Connect) Decode(r io.Reader, hdr Header, packetRemaining int32, confi
 		CleanSession:    flags&0x02 > 0,
 		KeepAliveTimer:  keepAliveTimer,
 		ClientId:        clientId,
+
+		SessionExpiryInterval: sessionExpiry,
 	}
 
 	if msg.WillFlag {
-		msg.WillTopic = getString(r, &packetRemaining)
-		msg.WillMessage = getString(r, &packetRemaining)
+		if protocolVersion >= 5 {
+			if packetRemaining <= 0 {
+				return ErrConnectPayloadMismatch
+			}
+			msg.WillProperties, msg.WillDelayInterval = getWillProperties(r, &packetRemaining)
+		}
+		msg.WillTopic = spanned(&spans.WillTopic, getConnectPayloadString)
+		msg.WillMessage = spanned(&spans.WillMessage, getConnectPayloadString)
+	} else {
+		// The will QoS is meaningless without a will, so any value sent by a
+		// non-conforming client is discarded rather than failing validation.
+		msg.WillQos = QosAtMostOnce
 	}
 	if msg.UsernameFlag {
-		msg.Username = getString(r, &packetRemaining)
+		msg.Username = spanned(&spans.Username, getConnectPayloadString)
 	}
 	if msg.PasswordFlag {
-		msg.Password = getString(r, &packetRemaining)
+		msg.Password = spanned(&spans.Password, getConnectPayloadString)
+	}
+
+	if decodeOptions(config).RecordConnectSpans {
+		msg.FieldSpans = &spans
 	}
 
+	// Any data left over means that the flags did not account for all of the
+	// payload fields.
 	if packetRemaining != 0 {
-		return msgTooLongError
+		return ErrConnectPayloadMismatch
 	}
 
 	return nil
 }
 
+func (msg *Connect) Reset() {
+	*msg = Connect{}
+}
+
+// Credentials returns the username and password of the message. The password
+// is returned as bytes, as MQTT passwords are binary data rather than text,
+// and is nil if PasswordFlag is false. ok is false if neither UsernameFlag nor
+// PasswordFlag is set.
+func (msg *Connect) Credentials() (username string, password []byte, ok bool) {
+	if msg.UsernameFlag {
+		username = msg.Username
+	}
+	if msg.PasswordFlag {
+		password = []byte(msg.Password)
+	}
+	return username, password, msg.UsernameFlag || msg.PasswordFlag
+}
+
+// SessionExpiry returns the MQTT 5.0 Session Expiry Interval of the message in
+// seconds, and whether it was present. An absent interval is equivalent to 0,
+// which ends the session when the connection closes, and 0xFFFFFFFF means
+// that the session never expires.
+func (msg *Connect) SessionExpiry() (seconds uint32, present bool) {
+	if msg.SessionExpiryInterval == nil {
+		return 0, false
+	}
+	return *msg.SessionExpiryInterval, true
+}
+
+// WillAsPublish returns the PUBLISH that delivers the will of the message,
+// or nil if WillFlag is not set. For MQTT 5.0 the PUBLISH carries a copy of
+// the will properties, which shares their CorrelationData and slices. The
+// MessageId is left zero, and must be set before encoding if the will QoS is
+// greater than 0.
+func (msg *Connect) WillAsPublish() *Publish {
+	if !msg.WillFlag {
+		return nil
+	}
+	publish := &Publish{
+		Header:    Header{QosLevel: msg.WillQos, Retain: msg.WillRetain},
+		TopicName: msg.WillTopic,
+		Payload:   BytesPayload(msg.WillMessage),
+	}
+	if msg.ProtocolVersion >= 5 {
+		publish.Properties = new(Properties)
+		if msg.WillProperties != nil {
+			*publish.Properties = *msg.WillProperties
+		}
+	}
+	return publish
+}
+
+// Will is the will of a CONNECT, the message that the server publishes if the
+// connection is closed without a DISCONNECT.
+type Will struct {
+	Topic   string
+	Message []byte
+	Qos     QosLevel
+	Retain  bool
+}
+
+// Will returns the will of the message, or false if WillFlag is not set.
+func (msg *Connect) Will() (*Will, bool) {
+	if !msg.WillFlag {
+		return nil, false
+	}
+	return &Will{
+		Topic:   msg.WillTopic,
+		Message: []byte(msg.WillMessage),
+		Qos:     msg.WillQos,
+		Retain:  msg.WillRetain,
+	}, true
+}
+
+// SetWill sets WillFlag and the will fields of the message from will, or
+// clears them all, including the MQTT 5.0 WillProperties and
+// WillDelayInterval, if will is nil.
+func (msg *Connect) SetWill(will *Will) {
+	if will == nil {
+		msg.WillFlag = false
+		msg.WillTopic = ""
+		msg.WillMessage = ""
+		msg.WillQos = QosAtMostOnce
+		msg.WillRetain = false
+		msg.WillProperties = nil
+		msg.WillDelayInterval = nil
+		return
+	}
+	msg.WillFlag = true
+	msg.WillTopic = will.Topic
+	msg.WillMessage = string(will.Message)
+	msg.WillQos = will.Qos
+	msg.WillRetain = will.Retain
+}
+
+// validate returns an error if msg cannot be encoded.
+func (msg *Connect) validate() error {
+	if !msg.WillQos.IsValid() {
+		return ErrBadWillQos
+	}
+	hasWillProperties := msg.WillProperties != nil || msg.WillDelayInterval != nil
+	if !msg.WillFlag && (msg.WillQos != QosAtMostOnce || msg.WillRetain || hasWillProperties) {
+		return ErrWillWithoutFlag
+	}
+	// MQTT 5.0 allows a password without a username.
+	if msg.PasswordFlag && !msg.UsernameFlag && msg.ProtocolVersion < 5 {
+		return ErrPasswordWithoutUsername
+	}
+	if !validProtocolVersion(msg.ProtocolName, msg.ProtocolVersion) {
+		return ErrProtocolMismatch
+	}
+	if (msg.SessionExpiryInterval != nil || hasWillProperties) && msg.ProtocolVersion < 5 {
+		return ErrUnsupportedVersion
+	}
+	if p := msg.WillProperties; p != nil {
+		if p.TopicAlias != nil || len(p.SubscriptionIdentifiers) > 0 {
+			return ErrBadProperty
+		}
+		if err := p.validate(); err != nil {
+			return err
+		}
+	}
+
+	for _, val := range []string{msg.ProtocolName, msg.ClientId, msg.WillTopic, msg.Username} {
+		if err := validateUTF8String(val); err != nil {
+			return err
+		}
+	}
+	// The will message and password are binary data.
+	for _, val := range []string{msg.WillMessage, msg.Password} {
+		if err := validateString(val); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ProtocolVersionName returns the protocol name and version that
+// ProtocolVersion identifies, such as "MQTT/3.1.1" for version 4, or "" for an
+// unknown version.
+func (msg *Connect) ProtocolVersionName() string {
+	switch msg.ProtocolVersion {
+	case 3:
+		return "MQIsdp/3.1"
+	case 4:
+		return "MQTT/3.1.1"
+	case 5:
+		return "MQTT/5.0"
+	}
+	return ""
+}
+
+// validProtocolVersion returns false if name is a known protocol name and
+// version is not a version of that protocol. "MQIsdp" is used by MQTT 3.1, and
+// "MQTT" by MQTT 3.1.1 and 5.0.
+func validProtocolVersion(name string, version uint8) bool {
+	switch name {
+	case "MQIsdp":
+		return version == 3
+	case "MQTT":
+		return version == 4 || version == 5
+	}
+	return true
+}
+
+// getConnectPayloadString reads a CONNECT payload field whose presence is
+// indicated by the connect flags. It raises ErrConnectPayloadMismatch if the
+// packet has no data left for the field.
+func getConnectPayloadString(r io.Reader, packetRemaining *int32) string {
+	if *packetRemaining <= 0 {
+		raiseError(ErrConnectPayloadMismatch)
+	}
+	return getString(r, packetRemaining)
+}
+
 // ConnAck represents an MQTT CONNACK message.
 type ConnAck struct {
 	Header
+	// SessionPresent is bit 0 of the acknowledge flags byte, which is reserved
+	// in MQTT 3.1 and indicates that the server holds session state for the
+	// client in MQTT 3.1.1.
+	SessionPresent bool
+	// ReturnCode holds the return code, or in MQTT 5.0 the reason code; when
+	// decoding with DecodeOptions.ProtocolVersion 5 or greater it is validated
+	// as a ReasonCode.
 	ReturnCode ReturnCode
 }
 
+// NewConnAck creates a CONNACK message with the given return code and
+// session present flag.
+func NewConnAck(rc ReturnCode, sessionPresent bool) *ConnAck {
+	return &ConnAck{SessionPresent: sessionPresent, ReturnCode: rc}
+}
+
 func (msg *ConnAck) Encode(w io.Writer) (err error) {
-	buf := new(bytes.Buffer)
+	buf := newMessageBuffer(2)
 
-	buf.WriteByte(byte(0)) // Reserved byte.
+	setUint8(boolToByte(msg.SessionPresent), buf) // Acknowledge flags.
 	setUint8(uint8(msg.ReturnCode), buf)
 
 	return writeMessage(w, MsgConnAck, &msg.Header, buf, 0)
 }
 
+func (msg *ConnAck) WriteTo(w io.Writer) (int64, error) {
+	return writeTo(w, msg)
+}
+
+func (msg *ConnAck) EncodedLen() (int, error) {
+	return encodedLen(&msg.Header, MsgConnAck, 2)
+}
+
 func (msg *ConnAck) Decode(r io.Reader, hdr Header, packetRemaining int32, config DecoderConfig) (err error) {
+	bodyLen := packetRemaining
 	defer func() {
-		err = recoverError(err, recover())
+		err = decodeError(recoverError(err, recover()), bodyLen, packetRemaining)
 	}()
 
 	msg.Header = hdr
 
-	getUint8(r, &packetRemaining) // Skip reserved byte.
+	ackFlags := getUint8(r, &packetRemaining)
+	msg.SessionPresent = ackFlags&0x01 > 0
 	msg.ReturnCode = ReturnCode(getUint8(r, &packetRemaining))
+
+	if decodeOptions(config).ProtocolVersion >= 5 {
+		if !ReasonCode(msg.ReturnCode).IsValid() {
+			return ErrBadReturnCode
+		}
+		// The properties that follow are not decoded.
+		if _, err := io.CopyN(io.Discard, r, int64(packetRemaining)); err != nil {
+			raiseError(io.ErrUnexpectedEOF)
+		}
+		packetRemaining = 0
+		return nil
+	}
+
 	if !msg.ReturnCode.IsValid() {
-		return badReturnCodeError
+		return ErrBadReturnCode
 	}
 
 	if packetRemaining != 0 {
-		return msgTooLongError
+		return ErrTrailingBytes
 	}
 
 	return nil
 }
 
+func (msg *ConnAck) Reset() {
+	*msg = ConnAck{}
+}
+
 // Publish represents an MQTT PUBLISH message.
 type Publish struct {
 	Header
 	TopicName string
 	MessageId uint16
-	Payload   Payload
+	// Properties holds the MQTT 5.0 properties of the message, and is nil for
+	// earlier protocol versions. It is decoded when
+	// DecodeOptions.ProtocolVersion is 5 or greater, and if non-nil, is encoded
+	// (even if empty).
+	Properties *Properties
+	// Payload may be nil, which is encoded as an empty payload.
+	Payload Payload
 }
 
 func (msg *Publish) Encode(w io.Writer) (err error) {
-	buf := new(bytes.Buffer)
+	if err = msg.validate(); err != nil {
+		return
+	}
+
+	bodyLen := 4 + len(msg.TopicName)
+	if msg.Properties != nil {
+		bodyLen += int(msg.Properties.encodedLen())
+	}
+	buf := newMessageBuffer(bodyLen)
 
 	setString(msg.TopicName, buf)
 	if msg.Header.QosLevel.HasId() {
 		setUint16(msg.MessageId, buf)
 	}
+	if msg.Properties != nil {
+		msg.Properties.encode(buf)
+	}
 
-	if err = writeMessage(w, MsgPublish, &msg.Header, buf, int32(msg.Payload.Size())); err != nil {
+	if err = writeMessage(w, MsgPublish, &msg.Header, buf, int32(msg.payloadSize())); err != nil {
 		return
 	}
 
+	if msg.Payload == nil {
+		return nil
+	}
 	return msg.Payload.WritePayload(w)
 }
 
+func (msg *Publish) WriteTo(w io.Writer) (int64, error) {
+	return writeTo(w, msg)
+}
+
+func (msg *Publish) EncodedLen() (int, error) {
+	if err := msg.validate(); err != nil {
+		return 0, err
+	}
+
+	length := 2 + int64(len(msg.TopicName))
+	if msg.Header.QosLevel.HasId() {
+		length += 2
+	}
+	if msg.Properties != nil {
+		length += msg.Properties.encodedLen()
+	}
+	length += int64(msg.payloadSize())
+
+	return encodedLen(&msg.Header, MsgPublish, length)
+}
+
+// payloadSize returns the size of the payload, treating a nil Payload as
+// empty.
+func (msg *Publish) payloadSize() int {
+	if msg.Payload == nil {
+		return 0
+	}
+	return msg.Payload.Size()
+}
+
 func (msg *Publish) Decode(r io.Reader, hdr Header, packetRemaining int32, config DecoderConfig) (err error) {
+	bodyLen := packetRemaining
 	defer func() {
-		err = recoverError(err, recover())
+		err = decodeError(recoverError(err, recover()), bodyLen, packetRemaining)
 	}()
 
+	// Header.Decode already rejects an invalid QoS, but Decode may be called
+	// directly with a Header from elsewhere. The QoS determines whether a
+	// MessageId is present, so an invalid QoS cannot be parsed past.
+	if !hdr.QosLevel.IsValid() {
+		return ErrBadQos
+	}
+
 	msg.Header = hdr
 
 	msg.TopicName = getString(r, &packetRemaining)
 	if msg.Header.QosLevel.HasId() {
+		if packetRemaining < 2 {
+			return ErrTruncatedPublish
+		}
 		msg.MessageId = getUint16(r, &packetRemaining)
 	}
+	if decodeOptions(config).ProtocolVersion >= 5 {
+		msg.Properties = getProperties(r, &packetRemaining)
+	}
+	if decodeOptions(config).Strict {
+		if err := msg.validateTopicName(); err != nil {
+			return err
+		}
+	}
 
 	payloadReader := &io.LimitedReader{r, int64(packetRemaining)}
 
 	if msg.Payload, err = config.MakePayload(msg, payloadReader, int(packetRemaining)); err != nil {
 		return
 	}
+	if payloadReader.N < int64(packetRemaining) {
+		// MakePayload has read the payload itself.
+		return nil
+	}
 
 	return msg.Payload.ReadPayload(payloadReader)
 }
 
+func (msg *Publish) Reset() {
+	*msg = Publish{}
+}
+
+// validate returns an error if msg cannot be encoded.
+func (msg *Publish) validate() error {
+	if msg.Header.DupFlag && !msg.Header.QosLevel.HasId() {
+		return ErrDupOnQos0
+	}
+	if msg.Header.QosLevel.HasId() && msg.MessageId == 0 {
+		return ErrMissingMessageId
+	}
+	if msg.Properties != nil {
+		if err := msg.Properties.validate(); err != nil {
+			return err
+		}
+	}
+	if err := validateUTF8String(msg.TopicName); err != nil {
+		return err
+	}
+	return msg.validateTopicName()
+}
+
+// validateTopicName returns ErrWildcardInTopicName if the topic name of msg
+// contains a wildcard, and ErrInvalidTopicName if it is otherwise invalid.
+func (msg *Publish) validateTopicName() error {
+	// An MQTT 5.0 PUBLISH may omit the topic name in favour of a Topic Alias.
+	if msg.TopicName == "" && msg.Properties != nil && msg.Properties.TopicAlias != nil {
+		return nil
+	}
+	if !ValidTopicName(msg.TopicName) {
+		if msg.TopicName != "" {
+			return ErrWildcardInTopicName
+		}
+		return ErrInvalidTopicName
+	}
+	return nil
+}
+
+// ShallowDeliveryClone returns a copy of msg that shares its Payload, for
+// delivering one PUBLISH to many subscribers. The Header and MessageId of the
+// copy can be changed per subscriber without affecting msg. Sharing the
+// Payload is only safe if it is not modified and can be written more than
+// once, as is the case for BytesPayload.
+func (msg *Publish) ShallowDeliveryClone() *Publish {
+	clone := *msg
+	return &clone
+}
+
+// WithRetain returns a shallow copy of msg, as ShallowDeliveryClone does, with
+// the RETAIN flag set to retain. A server sets RETAIN when delivering a
+// retained message to a new subscription, and clears it when forwarding a
+// PUBLISH to existing subscriptions, without modifying the stored message.
+func (msg *Publish) WithRetain(retain bool) *Publish {
+	clone := msg.ShallowDeliveryClone()
+	clone.Header.Retain = retain
+	return clone
+}
+
+// AckReason holds the MQTT 5.0 fields of a PUBACK, PUBREC, PUBREL or PUBCOMP
+// message.
+type AckReason struct {
+	// ProtocolVersion is the protocol version (as in Connect.ProtocolVersion)
+	// that the message is encoded for. Decode sets it from
+	// DecodeOptions.ProtocolVersion.
+	ProtocolVersion uint8
+
+	// ReasonCode is the MQTT 5.0 reason code, and ReasonString and
+	// UserProperties are the Reason String and User Property properties. They
+	// are only decoded and encoded when ProtocolVersion is 5 or greater. A
+	// zero reason code without properties is omitted when encoding, as is an
+	// empty property block. Messages of earlier versions only contain the
+	// message ID, so encoding any of these fields for them returns
+	// ErrUnsupportedVersion.
+	ReasonCode     ReasonCode
+	ReasonString   string
+	UserProperties []UserProperty
+}
+
+// propertiesSize returns the encoded size of the properties, excluding the
+// property length.
+func (a *AckReason) propertiesSize() int {
+	size := 0
+	if a.ReasonString != "" {
+		size += 1 + 2 + len(a.ReasonString)
+	}
+	for _, prop := range a.UserProperties {
+		size += 1 + 2 + len(prop.Key) + 2 + len(prop.Value)
+	}
+	return size
+}
+
+// encodedLen returns the encoded size of the fields, which follow the message
+// ID, or an error if they cannot be encoded.
+func (a *AckReason) encodedLen() (int, error) {
+	size := a.propertiesSize()
+	if a.ReasonCode == 0 && size == 0 {
+		return 0, nil
+	}
+	if a.ProtocolVersion < 5 {
+		return 0, ErrUnsupportedVersion
+	}
+	if size == 0 {
+		return 1, nil
+	}
+
+	strs := []string{a.ReasonString}
+	for _, prop := range a.UserProperties {
+		strs = append(strs, prop.Key, prop.Value)
+	}
+	for _, val := range strs {
+		if err := validateUTF8String(val); err != nil {
+			return 0, err
+		}
+	}
+	if size > maxVarInt {
+		return 0, ErrBadProperty
+	}
+	return 1 + encodedLengthSize(int32(size)) + size, nil
+}
+
+// encode writes the fields to buf. The encodedLen of a must be checked first.
+func (a *AckReason) encode(buf *bytes.Buffer) {
+	size := a.propertiesSize()
+	if a.ReasonCode == 0 && size == 0 {
+		return
+	}
+	setUint8(uint8(a.ReasonCode), buf)
+	if size == 0 {
+		return
+	}
+
+	encodeLength(int32(size), buf)
+	if a.ReasonString != "" {
+		setUint8(propReasonString, buf)
+		setString(a.ReasonString, buf)
+	}
+	for _, prop := range a.UserProperties {
+		setUint8(propUserProperty, buf)
+		setString(prop.Key, buf)
+		setString(prop.Value, buf)
+	}
+}
+
+// decode reads the fields that follow the message ID. The reason code and
+// properties are each optional, and are read only if packetRemaining shows
+// that they are present.
+func (a *AckReason) decode(r io.Reader, packetRemaining *int32, config DecoderConfig) {
+	*a = AckReason{ProtocolVersion: decodeOptions(config).ProtocolVersion}
+	if a.ProtocolVersion < 5 || *packetRemaining == 0 {
+		return
+	}
+
+	a.ReasonCode = ReasonCode(getUint8(r, packetRemaining))
+	if *packetRemaining == 0 {
+		return
+	}
+
+	hasReasonString := false
+	forEachProperty(r, packetRemaining, ackProperties, func(id uint32, remaining *int32) {
+		switch id {
+		case propReasonString:
+			if hasReasonString {
+				raiseError(ErrBadProperty)
+			}
+			hasReasonString = true
+			a.ReasonString = getString(r, remaining)
+		case propUserProperty:
+			key := getString(r, remaining)
+			value := getString(r, remaining)
+			a.UserProperties = append(a.UserProperties, UserProperty{Key: key, Value: value})
+		}
+	})
+}
+
 // PubAck represents an MQTT PUBACK message.
 type PubAck struct {
 	Header
 	MessageId uint16
+	AckReason
+}
+
+// NewPubAck creates a PUBACK message acknowledging the QoS 1 PUBLISH with
+// the given message ID.
+func NewPubAck(id uint16) *PubAck {
+	return &PubAck{MessageId: id}
 }
 
 func (msg *PubAck) Encode(w io.Writer) error {
-	return encodeAckCommon(w, &msg.Header, msg.MessageId, MsgPubAck)
+	return encodeAckCommon(w, &msg.Header, msg.MessageId, &msg.AckReason, MsgPubAck)
+}
+
+func (msg *PubAck) WriteTo(w io.Writer) (int64, error) {
+	return writeTo(w, msg)
+}
+
+func (msg *PubAck) EncodedLen() (int, error) {
+	return ackEncodedLen(&msg.Header, msg.MessageId, &msg.AckReason, MsgPubAck)
 }
 
 func (msg *PubAck) Decode(r io.Reader, hdr Header, packetRemaining int32, config DecoderConfig) (err error) {
 	msg.Header = hdr
-	return decodeAckCommon(r, packetRemaining, &msg.MessageId, config)
+	return decodeAckCommon(r, packetRemaining, &msg.MessageId, &msg.AckReason, config)
+}
+
+func (msg *PubAck) Reset() {
+	*msg = PubAck{}
 }
 
 // PubRec represents an MQTT PUBREC message.
 type PubRec struct {
 	Header
 	MessageId uint16
+	AckReason
+}
+
+// NewPubRec creates a PUBREC message acknowledging receipt of the QoS 2
+// PUBLISH with the given message ID.
+func NewPubRec(id uint16) *PubRec {
+	return &PubRec{MessageId: id}
 }
 
 func (msg *PubRec) Encode(w io.Writer) error {
-	return encodeAckCommon(w, &msg.Header, msg.MessageId, MsgPubRec)
+	return encodeAckCommon(w, &msg.Header, msg.MessageId, &msg.AckReason, MsgPubRec)
+}
+
+func (msg *PubRec) WriteTo(w io.Writer) (int64, error) {
+	return writeTo(w, msg)
+}
+
+func (msg *PubRec) EncodedLen() (int, error) {
+	return ackEncodedLen(&msg.Header, msg.MessageId, &msg.AckReason, MsgPubRec)
 }
 
 func (msg *PubRec) Decode(r io.Reader, hdr Header, packetRemaining int32, config DecoderConfig) (err error) {
 	msg.Header = hdr
-	return decodeAckCommon(r, packetRemaining, &msg.MessageId, config)
+	return decodeAckCommon(r, packetRemaining, &msg.MessageId, &msg.AckReason, config)
+}
+
+func (msg *PubRec) Reset() {
+	*msg = PubRec{}
 }
 
 // PubRel represents an MQTT PUBREL message.
 type PubRel struct {
 	Header
 	MessageId uint16
+	AckReason
+}
+
+// NewPubRel creates a PUBREL message for the given message ID, with the QoS 1
+// fixed header flags that PUBREL requires.
+func NewPubRel(id uint16) *PubRel {
+	return &PubRel{Header: Header{QosLevel: QosAtLeastOnce}, MessageId: id}
 }
 
 func (msg *PubRel) Encode(w io.Writer) error {
-	return encodeAckCommon(w, &msg.Header, msg.MessageId, MsgPubRel)
+	return encodeAckCommon(w, &msg.Header, msg.MessageId, &msg.AckReason, MsgPubRel)
+}
+
+func (msg *PubRel) WriteTo(w io.Writer) (int64, error) {
+	return writeTo(w, msg)
+}
+
+func (msg *PubRel) EncodedLen() (int, error) {
+	return ackEncodedLen(&msg.Header, msg.MessageId, &msg.AckReason, MsgPubRel)
 }
 
 func (msg *PubRel) Decode(r io.Reader, hdr Header, packetRemaining int32, config DecoderConfig) (err error) {
 	msg.Header = hdr
-	return decodeAckCommon(r, packetRemaining, &msg.MessageId, config)
+	return decodeAckCommon(r, packetRemaining, &msg.MessageId, &msg.AckReason, config)
+}
+
+func (msg *PubRel) Reset() {
+	*msg = PubRel{}
 }
 
 // PubComp represents an MQTT PUBCOMP message.
 type PubComp struct {
 	Header
 	MessageId uint16
+	AckReason
+}
+
+// NewPubComp creates a PUBCOMP message completing the QoS 2 flow for the
+// given message ID.
+func NewPubComp(id uint16) *PubComp {
+	return &PubComp{MessageId: id}
 }
 
 func (msg *PubComp) Encode(w io.Writer) error {
-	return encodeAckCommon(w, &msg.Header, msg.MessageId, MsgPubComp)
+	return encodeAckCommon(w, &msg.Header, msg.MessageId, &msg.AckReason, MsgPubComp)
+}
+
+func (msg *PubComp) WriteTo(w io.Writer) (int64, error) {
+	return writeTo(w, msg)
+}
+
+func (msg *PubComp) EncodedLen() (int, error) {
+	return ackEncodedLen(&msg.Header, msg.MessageId, &msg.AckReason, MsgPubComp)
 }
 
 func (msg *PubComp) Decode(r io.Reader, hdr Header, packetRemaining int32, config DecoderConfig) (err error) {
 	msg.Header = hdr
-	return decodeAckCommon(r, packetRemaining, &msg.MessageId, config)
+	return decodeAckCommon(r, packetRemaining, &msg.MessageId, &msg.AckReason, config)
+}
+
+func (msg *PubComp) Reset() {
+	*msg = PubComp{}
 }
 
 // Subscribe represents an MQTT SUBSCRIBE message.
@@ -370,7 +1219,15 @@ type TopicQos struct {
 }
 
 func (msg *Subscribe) Encode(w io.Writer) (err error) {
-	buf := new(bytes.Buffer)
+	if err = msg.validate(); err != nil {
+		return
+	}
+
+	bodyLen := 2
+	for _, topicSub := range msg.Topics {
+		bodyLen += 3 + len(topicSub.Topic)
+	}
+	buf := newMessageBuffer(bodyLen)
 	if msg.Header.QosLevel.HasId() {
 		setUint16(msg.MessageId, buf)
 	}
@@ -382,9 +1239,30 @@ func (msg *Subscribe) Encode(w io.Writer) (err error) {
 	return writeMessage(w, MsgSubscribe, &msg.Header, buf, 0)
 }
 
+func (msg *Subscribe) WriteTo(w io.Writer) (int64, error) {
+	return writeTo(w, msg)
+}
+
+func (msg *Subscribe) EncodedLen() (int, error) {
+	if err := msg.validate(); err != nil {
+		return 0, err
+	}
+
+	var length int64
+	if msg.Header.QosLevel.HasId() {
+		length += 2
+	}
+	for _, topicSub := range msg.Topics {
+		length += 2 + int64(len(topicSub.Topic)) + 1
+	}
+
+	return encodedLen(&msg.Header, MsgSubscribe, length)
+}
+
 func (msg *Subscribe) Decode(r io.Reader, hdr Header, packetRemaining int32, config DecoderConfig) (err error) {
+	bodyLen := packetRemaining
 	defer func() {
-		err = recoverError(err, recover())
+		err = decodeError(recoverError(err, recover()), bodyLen, packetRemaining)
 	}()
 
 	msg.Header = hdr
@@ -392,8 +1270,15 @@ func (msg *Subscribe) Decode(r io.Reader, hdr Header, packetRemaining int32, con
 	if msg.Header.QosLevel.HasId() {
 		msg.MessageId = getUint16(r, &packetRemaining)
 	}
-	var topics []TopicQos
+	topics := msg.Topics[:0]
+	if topics == nil {
+		topics = make([]TopicQos, 0)
+	}
+	maxTopics := decodeOptions(config).MaxTopics
 	for packetRemaining > 0 {
+		if maxTopics > 0 && len(topics) == maxTopics {
+			raiseError(ErrTooManyTopics)
+		}
 		topics = append(topics, TopicQos{
 			Topic: getString(r, &packetRemaining),
 			Qos:   QosLevel(getUint8(r, &packetRemaining)),
@@ -404,6 +1289,45 @@ func (msg *Subscribe) Decode(r io.Reader, hdr Header, packetRemaining int32, con
 	return nil
 }
 
+func (msg *Subscribe) Reset() {
+	*msg = Subscribe{Topics: msg.Topics[:0]}
+}
+
+// validate returns an error if msg cannot be encoded.
+func (msg *Subscribe) validate() error {
+	if msg.MessageId == 0 {
+		return ErrMissingMessageId
+	}
+	for _, topicSub := range msg.Topics {
+		if err := validateUTF8String(topicSub.Topic); err != nil {
+			return err
+		}
+		if !ValidTopicFilter(topicSub.Topic) {
+			return ErrInvalidTopicFilter
+		}
+	}
+	return nil
+}
+
+// SubAckWithAuth returns a SUBACK message acknowledging msg, with the QoS
+// granted for each topic filter determined by authorize. Filters for which
+// authorize returns allowed as false are given the SubAckFailure return code.
+func (msg *Subscribe) SubAckWithAuth(authorize func(filter string) (granted QosLevel, allowed bool)) *SubAck {
+	topicsQos := make([]QosLevel, len(msg.Topics))
+	for i, topic := range msg.Topics {
+		if granted, allowed := authorize(topic.Topic); allowed {
+			topicsQos[i] = granted
+		} else {
+			topicsQos[i] = SubAckFailure
+		}
+	}
+	return &SubAck{MessageId: msg.MessageId, TopicsQos: topicsQos}
+}
+
+// SubAckFailure is the SUBACK return code, in place of a granted QoS, that
+// indicates that the subscription to a topic failed (MQTT 3.1.1 onwards).
+const SubAckFailure = QosLevel(0x80)
+
 // SubAck represents an MQTT SUBACK message.
 type SubAck struct {
 	Header
@@ -411,8 +1335,24 @@ type SubAck struct {
 	TopicsQos []QosLevel
 }
 
+// NewSubAck creates a SUBACK message acknowledging the SUBSCRIBE with the
+// given message ID, with one granted QoS per requested topic. Each entry must
+// be a valid QoS level or SubAckFailure, otherwise ErrBadQos is returned.
+func NewSubAck(messageId uint16, granted []QosLevel) (*SubAck, error) {
+	for _, qos := range granted {
+		if !qos.IsValid() && qos != SubAckFailure {
+			return nil, ErrBadQos
+		}
+	}
+	return &SubAck{MessageId: messageId, TopicsQos: granted}, nil
+}
+
 func (msg *SubAck) Encode(w io.Writer) (err error) {
-	buf := new(bytes.Buffer)
+	if msg.MessageId == 0 {
+		return ErrMissingMessageId
+	}
+
+	buf := newMessageBuffer(2 + len(msg.TopicsQos))
 	setUint16(msg.MessageId, buf)
 	for i := 0; i < len(msg.TopicsQos); i += 1 {
 		setUint8(uint8(msg.TopicsQos[i]), buf)
@@ -421,17 +1361,39 @@ func (msg *SubAck) Encode(w io.Writer) (err error) {
 	return writeMessage(w, MsgSubAck, &msg.Header, buf, 0)
 }
 
+func (msg *SubAck) WriteTo(w io.Writer) (int64, error) {
+	return writeTo(w, msg)
+}
+
+func (msg *SubAck) EncodedLen() (int, error) {
+	if msg.MessageId == 0 {
+		return 0, ErrMissingMessageId
+	}
+	return encodedLen(&msg.Header, MsgSubAck, 2+int64(len(msg.TopicsQos)))
+}
+
 func (msg *SubAck) Decode(r io.Reader, hdr Header, packetRemaining int32, config DecoderConfig) (err error) {
+	bodyLen := packetRemaining
 	defer func() {
-		err = recoverError(err, recover())
+		err = decodeError(recoverError(err, recover()), bodyLen, packetRemaining)
 	}()
 
 	msg.Header = hdr
 
 	msg.MessageId = getUint16(r, &packetRemaining)
-	topicsQos := make([]QosLevel, 0)
+	topicsQos := msg.TopicsQos[:0]
+	if topicsQos == nil {
+		topicsQos = make([]QosLevel, 0)
+	}
+	maxTopics := decodeOptions(config).MaxTopics
 	for packetRemaining > 0 {
-		grantedQos := QosLevel(getUint8(r, &packetRemaining) & 0x03)
+		if maxTopics > 0 && len(topicsQos) == maxTopics {
+			raiseError(ErrTooManyTopics)
+		}
+		grantedQos := QosLevel(getUint8(r, &packetRemaining))
+		if grantedQos != SubAckFailure {
+			grantedQos &= 0x03
+		}
 		topicsQos = append(topicsQos, grantedQos)
 	}
 	msg.TopicsQos = topicsQos
@@ -439,6 +1401,10 @@ func (msg *SubAck) Decode(r io.Reader, hdr Header, packetRemaining int32, config
 	return nil
 }
 
+func (msg *SubAck) Reset() {
+	*msg = SubAck{TopicsQos: msg.TopicsQos[:0]}
+}
+
 // Unsubscribe represents an MQTT UNSUBSCRIBE message.
 type Unsubscribe struct {
 	Header
@@ -447,7 +1413,15 @@ type Unsubscribe struct {
 }
 
 func (msg *Unsubscribe) Encode(w io.Writer) (err error) {
-	buf := new(bytes.Buffer)
+	if err = msg.validate(); err != nil {
+		return
+	}
+
+	bodyLen := 2
+	for _, topic := range msg.Topics {
+		bodyLen += 2 + len(topic)
+	}
+	buf := newMessageBuffer(bodyLen)
 	if msg.Header.QosLevel.HasId() {
 		setUint16(msg.MessageId, buf)
 	}
@@ -458,9 +1432,30 @@ func (msg *Unsubscribe) Encode(w io.Writer) (err error) {
 	return writeMessage(w, MsgUnsubscribe, &msg.Header, buf, 0)
 }
 
+func (msg *Unsubscribe) WriteTo(w io.Writer) (int64, error) {
+	return writeTo(w, msg)
+}
+
+func (msg *Unsubscribe) EncodedLen() (int, error) {
+	if err := msg.validate(); err != nil {
+		return 0, err
+	}
+
+	var length int64
+	if msg.Header.QosLevel.HasId() {
+		length += 2
+	}
+	for _, topic := range msg.Topics {
+		length += 2 + int64(len(topic))
+	}
+
+	return encodedLen(&msg.Header, MsgUnsubscribe, length)
+}
+
 func (msg *Unsubscribe) Decode(r io.Reader, hdr Header, packetRemaining int32, config DecoderConfig) (err error) {
+	bodyLen := packetRemaining
 	defer func() {
-		err = recoverError(err, recover())
+		err = decodeError(recoverError(err, recover()), bodyLen, packetRemaining)
 	}()
 
 	msg.Header = hdr
@@ -468,8 +1463,15 @@ func (msg *Unsubscribe) Decode(r io.Reader, hdr Header, packetRemaining int32, c
 	if qos := msg.Header.QosLevel; qos == 1 || qos == 2 {
 		msg.MessageId = getUint16(r, &packetRemaining)
 	}
-	topics := make([]string, 0)
+	topics := msg.Topics[:0]
+	if topics == nil {
+		topics = make([]string, 0)
+	}
+	maxTopics := decodeOptions(config).MaxTopics
 	for packetRemaining > 0 {
+		if maxTopics > 0 && len(topics) == maxTopics {
+			raiseError(ErrTooManyTopics)
+		}
 		topics = append(topics, getString(r, &packetRemaining))
 	}
 	msg.Topics = topics
@@ -477,19 +1479,57 @@ func (msg *Unsubscribe) Decode(r io.Reader, hdr Header, packetRemaining int32, c
 	return nil
 }
 
+func (msg *Unsubscribe) Reset() {
+	*msg = Unsubscribe{Topics: msg.Topics[:0]}
+}
+
+// validate returns an error if msg cannot be encoded.
+func (msg *Unsubscribe) validate() error {
+	if msg.MessageId == 0 {
+		return ErrMissingMessageId
+	}
+	for _, topic := range msg.Topics {
+		if err := validateUTF8String(topic); err != nil {
+			return err
+		}
+		if !ValidTopicFilter(topic) {
+			return ErrInvalidTopicFilter
+		}
+	}
+	return nil
+}
+
 // UnsubAck represents an MQTT UNSUBACK message.
 type UnsubAck struct {
 	Header
 	MessageId uint16
 }
 
+// NewUnsubAck creates an UNSUBACK message acknowledging the UNSUBSCRIBE with
+// the given message ID.
+func NewUnsubAck(id uint16) *UnsubAck {
+	return &UnsubAck{MessageId: id}
+}
+
 func (msg *UnsubAck) Encode(w io.Writer) error {
-	return encodeAckCommon(w, &msg.Header, msg.MessageId, MsgUnsubAck)
+	return encodeAckCommon(w, &msg.Header, msg.MessageId, nil, MsgUnsubAck)
+}
+
+func (msg *UnsubAck) WriteTo(w io.Writer) (int64, error) {
+	return writeTo(w, msg)
+}
+
+func (msg *UnsubAck) EncodedLen() (int, error) {
+	return ackEncodedLen(&msg.Header, msg.MessageId, nil, MsgUnsubAck)
 }
 
 func (msg *UnsubAck) Decode(r io.Reader, hdr Header, packetRemaining int32, config DecoderConfig) (err error) {
 	msg.Header = hdr
-	return decodeAckCommon(r, packetRemaining, &msg.MessageId, config)
+	return decodeAckCommon(r, packetRemaining, &msg.MessageId, nil, config)
+}
+
+func (msg *UnsubAck) Reset() {
+	*msg = UnsubAck{}
 }
 
 // PingReq represents an MQTT PINGREQ message.
@@ -501,13 +1541,25 @@ func (msg *PingReq) Encode(w io.Writer) error {
 	return msg.Header.Encode(w, MsgPingReq, 0)
 }
 
+func (msg *PingReq) WriteTo(w io.Writer) (int64, error) {
+	return writeTo(w, msg)
+}
+
+func (msg *PingReq) EncodedLen() (int, error) {
+	return encodedLen(&msg.Header, MsgPingReq, 0)
+}
+
 func (msg *PingReq) Decode(r io.Reader, hdr Header, packetRemaining int32, config DecoderConfig) error {
 	if packetRemaining != 0 {
-		return msgTooLongError
+		return decodeError(ErrTrailingBytes, packetRemaining, packetRemaining)
 	}
 	return nil
 }
 
+func (msg *PingReq) Reset() {
+	*msg = PingReq{}
+}
+
 // PingResp represents an MQTT PINGRESP message.
 type PingResp struct {
 	Header
@@ -517,44 +1569,191 @@ func (msg *PingResp) Encode(w io.Writer) error {
 	return msg.Header.Encode(w, MsgPingResp, 0)
 }
 
+func (msg *PingResp) WriteTo(w io.Writer) (int64, error) {
+	return writeTo(w, msg)
+}
+
+func (msg *PingResp) EncodedLen() (int, error) {
+	return encodedLen(&msg.Header, MsgPingResp, 0)
+}
+
 func (msg *PingResp) Decode(r io.Reader, hdr Header, packetRemaining int32, config DecoderConfig) error {
 	if packetRemaining != 0 {
-		return msgTooLongError
+		return decodeError(ErrTrailingBytes, packetRemaining, packetRemaining)
 	}
 	return nil
 }
 
+func (msg *PingResp) Reset() {
+	*msg = PingResp{}
+}
+
 // Disconnect represents an MQTT DISCONNECT message.
 type Disconnect struct {
 	Header
+
+	// ProtocolVersion is the protocol version (as in Connect.ProtocolVersion)
+	// that the message is encoded for. Decode sets it from
+	// DecodeOptions.ProtocolVersion.
+	ProtocolVersion uint8
+
+	// ReasonCode is the MQTT 5.0 disconnect reason code. It is only decoded
+	// and encoded when ProtocolVersion is 5 or greater, and is only encoded if
+	// non-zero or ReasonString is set, as a zero reason code (normal
+	// disconnection) may be omitted. DISCONNECT messages of earlier versions
+	// have no body, so encoding a non-zero reason code or a ReasonString for
+	// them returns ErrUnsupportedVersion.
+	ReasonCode ReasonCode
+	// ReasonString is the MQTT 5.0 Reason String property, a human readable
+	// diagnostic. It is encoded if non-empty. Other properties are not
+	// decoded.
+	ReasonString string
 }
 
 func (msg *Disconnect) Encode(w io.Writer) error {
-	return msg.Header.Encode(w, MsgDisconnect, 0)
+	if msg.ReasonCode == ReasonSuccess && msg.ReasonString == "" {
+		return msg.Header.Encode(w, MsgDisconnect, 0)
+	}
+	if msg.ProtocolVersion < 5 {
+		return ErrUnsupportedVersion
+	}
+	if err := validateUTF8String(msg.ReasonString); err != nil {
+		return err
+	}
+
+	buf := newMessageBuffer(5 + len(msg.ReasonString))
+	setUint8(uint8(msg.ReasonCode), buf)
+	if msg.ReasonString != "" {
+		encodeLength(int32(3+len(msg.ReasonString)), buf)
+		setUint8(propReasonString, buf)
+		setString(msg.ReasonString, buf)
+	}
+	return writeMessage(w, MsgDisconnect, &msg.Header, buf, 0)
 }
 
-func (msg *Disconnect) Decode(r io.Reader, hdr Header, packetRemaining int32, config DecoderConfig) error {
+func (msg *Disconnect) WriteTo(w io.Writer) (int64, error) {
+	return writeTo(w, msg)
+}
+
+func (msg *Disconnect) EncodedLen() (int, error) {
+	if msg.ReasonCode == ReasonSuccess && msg.ReasonString == "" {
+		return encodedLen(&msg.Header, MsgDisconnect, 0)
+	}
+	if msg.ProtocolVersion < 5 {
+		return 0, ErrUnsupportedVersion
+	}
+	if err := validateUTF8String(msg.ReasonString); err != nil {
+		return 0, err
+	}
+
+	length := int64(1)
+	if msg.ReasonString != "" {
+		propsLen := int32(3 + len(msg.ReasonString))
+		length += int64(encodedLengthSize(propsLen)) + int64(propsLen)
+	}
+	return encodedLen(&msg.Header, MsgDisconnect, length)
+}
+
+func (msg *Disconnect) Decode(r io.Reader, hdr Header, packetRemaining int32, config DecoderConfig) (err error) {
+	bodyLen := packetRemaining
+	defer func() {
+		err = decodeError(recoverError(err, recover()), bodyLen, packetRemaining)
+	}()
+
+	msg.Header = hdr
+	msg.ProtocolVersion = decodeOptions(config).ProtocolVersion
+
+	if packetRemaining == 0 {
+		return nil
+	}
+	if msg.ProtocolVersion < 5 {
+		return ErrTrailingBytes
+	}
+
+	msg.ReasonCode = ReasonCode(getUint8(r, &packetRemaining))
+	if packetRemaining > 0 {
+		msg.ReasonString = getDisconnectProperties(r, &packetRemaining)
+	}
+
 	if packetRemaining != 0 {
-		return msgTooLongError
+		return ErrTrailingBytes
 	}
+
 	return nil
 }
 
-func encodeAckCommon(w io.Writer, hdr *Header, messageId uint16, msgType MessageType) error {
-	buf := new(bytes.Buffer)
+func (msg *Disconnect) Reset() {
+	*msg = Disconnect{}
+}
+
+// ClearsWill returns true if the server should discard the will of the
+// connection on receiving msg, rather than publishing it. Only a normal
+// disconnection clears the will: any other MQTT 5.0 reason code, whether
+// Disconnect with Will Message (0x04) or an error, asks the server to publish
+// it. A DISCONNECT always indicates a normal disconnection in MQTT 3.1 and
+// 3.1.1.
+func (msg *Disconnect) ClearsWill() bool {
+	return msg.ReasonCode == ReasonSuccess
+}
+
+func writeTo(w io.Writer, msg Message) (int64, error) {
+	cw := &countingWriter{w: w}
+	err := msg.Encode(cw)
+	return cw.n, err
+}
+
+// encodeAckCommon encodes a message consisting of a message ID, followed by
+// the fields of reason if it is non-nil.
+func encodeAckCommon(w io.Writer, hdr *Header, messageId uint16, reason *AckReason, msgType MessageType) error {
+	if messageId == 0 {
+		return ErrMissingMessageId
+	}
+	if reason != nil {
+		if _, err := reason.encodedLen(); err != nil {
+			return err
+		}
+	}
+
+	buf := newMessageBuffer(2)
 	setUint16(messageId, buf)
+	if reason != nil {
+		reason.encode(buf)
+	}
 	return writeMessage(w, msgType, hdr, buf, 0)
 }
 
-func decodeAckCommon(r io.Reader, packetRemaining int32, messageId *uint16, config DecoderConfig) (err error) {
+// ackEncodedLen returns the encoded length of a message consisting of a
+// message ID, followed by the fields of reason if it is non-nil.
+func ackEncodedLen(hdr *Header, messageId uint16, reason *AckReason, msgType MessageType) (int, error) {
+	if messageId == 0 {
+		return 0, ErrMissingMessageId
+	}
+	length := 2
+	if reason != nil {
+		n, err := reason.encodedLen()
+		if err != nil {
+			return 0, err
+		}
+		length += n
+	}
+	return encodedLen(hdr, msgType, int64(length))
+}
+
+// decodeAckCommon decodes a message consisting of a message ID, followed by
+// the fields of reason if it is non-nil.
+func decodeAckCommon(r io.Reader, packetRemaining int32, messageId *uint16, reason *AckReason, config DecoderConfig) (err error) {
+	bodyLen := packetRemaining
 	defer func() {
-		err = recoverError(err, recover())
+		err = decodeError(recoverError(err, recover()), bodyLen, packetRemaining)
 	}()
 
 	*messageId = getUint16(r, &packetRemaining)
+	if reason != nil {
+		reason.decode(r, &packetRemaining, config)
+	}
 
 	if packetRemaining != 0 {
-		return msgTooLongError
+		return ErrTrailingBytes
 	}
 
 	return nil
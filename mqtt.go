@@ -72,20 +72,95 @@
 package mqtt
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
 	"io"
+	"strconv"
 )
 
+// Errors returned when encoding or decoding messages. These may be compared
+// against returned errors using errors.Is.
 var (
-	badMsgTypeError        = errors.New("mqtt: message type is invalid")
-	badQosError            = errors.New("mqtt: QoS is invalid")
-	badWillQosError        = errors.New("mqtt: will QoS is invalid")
-	badLengthEncodingError = errors.New("mqtt: remaining length field exceeded maximum of 4 bytes")
-	badReturnCodeError     = errors.New("mqtt: is invalid")
-	dataExceedsPacketError = errors.New("mqtt: data exceeds packet length")
-	msgTooLongError        = errors.New("mqtt: message is too long")
+	ErrBadMsgType        = errors.New("mqtt: message type is invalid")
+	ErrBadQos            = errors.New("mqtt: QoS is invalid")
+	ErrBadWillQos        = errors.New("mqtt: will QoS is invalid")
+	ErrBadLengthEncoding = errors.New("mqtt: remaining length field exceeded maximum of 4 bytes")
+	ErrBadReturnCode     = errors.New("mqtt: is invalid")
+	ErrDataExceedsPacket = errors.New("mqtt: data exceeds packet length")
+	ErrMsgTooLong        = errors.New("mqtt: message is too long")
+
+	ErrConnectPayloadMismatch  = errors.New("mqtt: CONNECT payload does not match its flags")
+	ErrInvalidFixedHeaderFlags = errors.New("mqtt: fixed header flags are invalid for the message type")
+	ErrUnsupportedVersion      = errors.New("mqtt: message is not supported for the protocol version")
+	ErrBadProperty             = errors.New("mqtt: property is invalid")
+	ErrUnexpectedMsgType       = errors.New("mqtt: message type is not the type expected")
+	ErrTrailingBytes           = errors.New("mqtt: unexpected data at end of message")
+	ErrMaxPackets              = errors.New("mqtt: decoder has read the maximum number of messages")
+	ErrBadFramePrefixWidth     = errors.New("mqtt: frame length prefix width must be 1, 2 or 4 bytes")
+	ErrFrameTooLong            = errors.New("mqtt: message is too long for frame length prefix")
+	ErrProtocolMismatch        = errors.New("mqtt: protocol version does not match protocol name")
+	ErrDupOnQos0               = errors.New("mqtt: DUP flag is set on QoS 0 PUBLISH")
+	ErrStringTooLong           = errors.New("mqtt: string is longer than 65535 bytes")
+	ErrInvalidString           = errors.New("mqtt: string is not valid MQTT UTF-8")
+	ErrBadRetainHandling       = errors.New("mqtt: retain handling subscription option is invalid")
+	ErrNoLocalOnShared         = errors.New("mqtt: No Local is set on a shared subscription")
+	ErrBadSharedSubscription   = errors.New("mqtt: shared subscription topic filter is malformed")
+	ErrPacketTooLarge          = errors.New("mqtt: remaining length exceeds the configured maximum")
+	ErrBadHandshake            = errors.New("mqtt: invalid connection handshake")
+	ErrChecksumMismatch        = errors.New("mqtt: message checksum does not match")
+	ErrReservedFlagSet         = errors.New("mqtt: reserved CONNECT flag is set")
+	ErrMissingMessageId        = errors.New("mqtt: message ID is required but is zero")
+	ErrMessageIdOnQos0         = errors.New("mqtt: message ID is set on QoS 0 PUBLISH")
+	ErrBufferTooSmall          = errors.New("mqtt: payload is larger than the destination buffer")
+	ErrNoMessageId             = errors.New("mqtt: message does not carry a message ID")
+	ErrWillWithoutFlag         = errors.New("mqtt: will QoS or retain is set without the will flag")
+	ErrPasswordWithoutUsername = errors.New("mqtt: password flag is set without the username flag")
+	ErrPacketTimeout           = errors.New("mqtt: message was not received within the packet timeout")
+	ErrOptionNotApplicable     = errors.New("mqtt: option does not apply to the message type")
+	ErrIncompletePacket        = errors.New("mqtt: buffered message is incomplete")
+	ErrTooManyTopics           = errors.New("mqtt: message has more topics than the configured maximum")
+	ErrInvalidTopicFilter      = errors.New("mqtt: topic filter is invalid")
+	ErrInvalidTopicName        = errors.New("mqtt: topic name is invalid")
+	ErrInternal                = errors.New("mqtt: internal error")
+	ErrWildcardInTopicName     = fmt.Errorf("%w: it contains a wildcard", ErrInvalidTopicName)
+	ErrTruncatedPublish        = errors.New("mqtt: PUBLISH of QoS 1 or 2 ends before its message ID")
 )
 
+// DecodeError is the error returned when a message body fails to decode. It
+// wraps the underlying error, and records the offset in the message at which
+// decoding failed.
+type DecodeError struct {
+	err    error
+	offset int
+}
+
+func (e *DecodeError) Error() string {
+	return e.err.Error() + " at offset " + strconv.Itoa(e.offset)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.err
+}
+
+// Offset returns the offset of the failure relative to the first byte of the
+// message's fixed header, assuming that the remaining length was encoded in
+// the minimum number of bytes.
+func (e *DecodeError) Offset() int {
+	return e.offset
+}
+
+// decodeError wraps err, if non-nil, in a *DecodeError. bodyLen is the
+// remaining length from the fixed header, and bodyRemaining is the part of it
+// that had not been consumed when err occurred.
+func decodeError(err error, bodyLen, bodyRemaining int32) error {
+	if err == nil {
+		return nil
+	}
+	offset := 1 + encodedLengthSize(bodyLen) + int(bodyLen-bodyRemaining)
+	return &DecodeError{err: err, offset: offset}
+}
+
 const (
 	QosAtMostOnce = QosLevel(iota)
 	QosAtLeastOnce
@@ -121,19 +196,67 @@ func (rc ReturnCode) IsValid() bool {
 	return rc >= RetCodeAccepted && rc < retCodeFirstInvalid
 }
 
+// ReasonCode is an MQTT 5.0 reason code, which replaces the return code of
+// earlier versions. Values below 0x80 indicate success, and values of 0x80 or
+// greater indicate failure.
+type ReasonCode uint8
+
+const (
+	ReasonSuccess             = ReasonCode(0x00)
+	ReasonUnspecifiedError    = ReasonCode(0x80)
+	ReasonMalformedPacket     = ReasonCode(0x81)
+	ReasonProtocolError       = ReasonCode(0x82)
+	ReasonImplementationError = ReasonCode(0x83)
+	ReasonNotAuthorized       = ReasonCode(0x87)
+	ReasonServerShuttingDown  = ReasonCode(0x8b)
+	ReasonKeepAliveTimeout    = ReasonCode(0x8d)
+	ReasonTopicFilterInvalid  = ReasonCode(0x8f)
+	ReasonTopicNameInvalid    = ReasonCode(0x90)
+	ReasonPacketTooLarge      = ReasonCode(0x95)
+	ReasonQuotaExceeded       = ReasonCode(0x97)
+	reasonFirstInvalidFailure = ReasonCode(0xa0)
+)
+
+// IsValid returns true if rc is success (0x00) or one of the failure reason
+// codes (0x80 to 0x9F) that may be sent in a CONNACK or DISCONNECT.
+func (rc ReasonCode) IsValid() bool {
+	return rc == ReasonSuccess || (rc >= ReasonUnspecifiedError && rc < reasonFirstInvalidFailure)
+}
+
 // DecoderConfig provides configuration for decoding messages.
 type DecoderConfig interface {
 	// MakePayload returns a Payload for the given Publish message. r is a Reader
 	// that will read the payload data, and n is the number of bytes in the
 	// payload. The Payload.ReadPayload method is called on the returned payload
-	// by the decoding process.
+	// by the decoding process, unless MakePayload has read from r itself, in
+	// which case it must have read the whole payload.
 	MakePayload(msg *Publish, r io.Reader, n int) (Payload, error)
 }
 
+// maxPreallocatedPayload is the largest payload size for which
+// DefaultDecoderConfig allocates the payload before reading it.
+const maxPreallocatedPayload = 64 * 1024
+
+// DefaultDecoderConfig decodes PUBLISH payloads as a BytesPayload. An empty
+// payload, as of a retained PUBLISH that clears the retained message for its
+// topic, is decoded as an empty but non-nil BytesPayload. A payload that
+// claims to be larger than 64KiB is read into a buffer that grows as the data
+// arrives, so that a short message cannot cause a large allocation.
 type DefaultDecoderConfig struct{}
 
 func (c DefaultDecoderConfig) MakePayload(msg *Publish, r io.Reader, n int) (Payload, error) {
-	return make(BytesPayload, n), nil
+	if n <= maxPreallocatedPayload {
+		return make(BytesPayload, n), nil
+	}
+
+	buf := new(bytes.Buffer)
+	if _, err := io.CopyN(buf, r, int64(n)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return BytesPayload(buf.Bytes()), nil
 }
 
 // ValueConfig always returns the given Payload when MakePayload is called.
@@ -145,32 +268,215 @@ func (c *ValueConfig) MakePayload(msg *Publish, r io.Reader, n int) (Payload, er
 	return c.Payload, nil
 }
 
+// DecodeOptions is a DecoderConfig that provides optional decoding behaviour
+// in addition to creating payloads. It may be passed as the config parameter
+// of DecodeOneMessage or DecodeInto, or used with DecodeOneMessageOptions.
+type DecodeOptions struct {
+	// Config creates payloads for Publish messages. nil indicates that the
+	// DefaultDecoderConfig should be used.
+	Config DecoderConfig
+
+	// Strict enables enforcement of rules that are not needed to parse
+	// messages, such as the values of the reserved fixed header flags, the
+	// reserved CONNECT flag, and the validity of PUBLISH topic names.
+	// Decoding is lenient by default, to allow best-effort parsing of traffic
+	// that violates the specification in these ways.
+	Strict bool
+
+	// RecordConnectSpans sets Connect.FieldSpans on decoded CONNECT messages.
+	RecordConnectSpans bool
+
+	// MaxRemainingLength, if non-zero, is the largest remaining length that
+	// will be accepted in a fixed header. Larger messages are rejected with
+	// ErrPacketTooLarge before any of their body is read or allocated for, and
+	// the body is left unread in the reader.
+	MaxRemainingLength int32
+
+	// MaxTopics, if non-zero, is the largest number of topics that will be
+	// decoded from a SUBSCRIBE, UNSUBSCRIBE or SUBACK. Messages with more are
+	// rejected with ErrTooManyTopics, which bounds the memory that a message
+	// within MaxRemainingLength can cause to be allocated.
+	MaxTopics int
+
+	// ProtocolVersion is the protocol version (as in Connect.ProtocolVersion)
+	// that messages are decoded for. Zero indicates MQTT 3.1 or 3.1.1, which
+	// are decoded identically. Version 5 enables decoding of the MQTT 5.0
+	// fields that this package supports. Only CONNECT, CONNACK, PUBLISH,
+	// PUBACK, PUBREC, PUBREL, PUBCOMP, PINGREQ, PINGRESP and DISCONNECT
+	// messages, and types registered with RegisterMessage, can be decoded for
+	// version 5 so far; other message types are skipped and
+	// ErrUnsupportedVersion is returned. A CONNECT is always decoded for the
+	// version that it contains.
+	//
+	// Only a CONNECT carries the protocol version, so a server should set this
+	// from the CONNECT for the messages that follow it on the connection, such
+	// as by replacing Decoder.Config.
+	ProtocolVersion uint8
+}
+
+func (o DecodeOptions) MakePayload(msg *Publish, r io.Reader, n int) (Payload, error) {
+	if o.Config == nil {
+		return DefaultDecoderConfig{}.MakePayload(msg, r, n)
+	}
+	return o.Config.MakePayload(msg, r, n)
+}
+
+// decodeOptions returns the DecodeOptions within config, or the default
+// options if config is not a DecodeOptions.
+func decodeOptions(config DecoderConfig) DecodeOptions {
+	switch config := config.(type) {
+	case DecodeOptions:
+		return config
+	case *DecodeOptions:
+		return *config
+	}
+	return DecodeOptions{Config: config}
+}
+
 // DecodeOneMessage decodes one message from r. config provides specifics on
 // how to decode messages, nil indicates that the DefaultDecoderConfig should
 // be used.
+//
+// If the message type is invalid (including the reserved types 0 and 15,
+// unless registered with RegisterMessage), or the QoS bits of the fixed header
+// are invalid, ErrBadMsgType or ErrBadQos is returned after the message body
+// has been read and discarded from r, so that r remains positioned at the start
+// of the next message. The body is not discarded if it is longer than
+// DecodeOptions.MaxRemainingLength; in that case ErrPacketTooLarge is returned.
 func DecodeOneMessage(r io.Reader, config DecoderConfig) (msg Message, err error) {
 	var hdr Header
 	var msgType MessageType
 	var packetRemaining int32
 	msgType, packetRemaining, err = hdr.Decode(r)
 	if err != nil {
-		return
+		return nil, skipBody(r, packetRemaining, config, err)
 	}
 
 	msg, err = NewMessage(msgType)
 	if err != nil {
-		return
+		return nil, skipBody(r, packetRemaining, config, err)
 	}
 
+	return msg, decodeBody(r, msg, hdr, msgType, packetRemaining, config)
+}
+
+// DecodeOneMessageOptions decodes one message from r using the given options.
+func DecodeOneMessageOptions(r io.Reader, opts DecodeOptions) (Message, error) {
+	return DecodeOneMessage(r, opts)
+}
+
+// DecodeOneMessageRaw decodes one message from r in the same way as
+// DecodeOneMessage, and also returns a copy of the bytes read from r to decode
+// the message, such as for forwarding it verbatim. If an error occurs, raw
+// holds the bytes read up to that point.
+func DecodeOneMessageRaw(r io.Reader, config DecoderConfig) (msg Message, raw []byte, err error) {
+	var buf bytes.Buffer
+	msg, err = DecodeOneMessage(io.TeeReader(r, &buf), config)
+	return msg, buf.Bytes(), err
+}
+
+// bufferConfig is a DecoderConfig that decodes Publish payloads into a
+// caller-supplied buffer.
+type bufferConfig []byte
+
+func (c bufferConfig) MakePayload(msg *Publish, r io.Reader, n int) (Payload, error) {
+	if n > len(c) {
+		return nil, ErrBufferTooSmall
+	}
+	return BytesPayload(c[:n]), nil
+}
+
+// DecodePublishInto decodes one message from r in the same way as
+// DecodeOneMessage, except that the payload of a Publish message is read into
+// dst rather than a newly allocated slice. n is the length of the payload,
+// which is 0 for other message types. If the payload is longer than dst,
+// ErrBufferTooSmall is returned and the payload is left unread in r.
+func DecodePublishInto(r io.Reader, dst []byte) (msg Message, n int, err error) {
+	msg, err = DecodeOneMessage(r, bufferConfig(dst))
+	if pub, ok := msg.(*Publish); ok && err == nil {
+		n = len(pub.Payload.(BytesPayload))
+	}
+	return msg, n, err
+}
+
+// DecodeInto decodes one message from r into msg, which is reset first if it
+// implements Resetter. This allows a Message value to be reused between calls
+// rather than allocating a new one for each message. If the decoded message
+// type is not that of msg, or its QoS bits are invalid, ErrUnexpectedMsgType
+// or ErrBadQos is returned after the message body has been read and discarded
+// from r. config is treated as for DecodeOneMessage.
+func DecodeInto(r io.Reader, msg Message, config DecoderConfig) (err error) {
+	var hdr Header
+	var msgType MessageType
+	var packetRemaining int32
+	msgType, packetRemaining, err = hdr.Decode(r)
+	if err != nil {
+		return skipBody(r, packetRemaining, config, err)
+	}
+
+	if msgType != messageTypeOf(msg) {
+		return skipBody(r, packetRemaining, config, ErrUnexpectedMsgType)
+	}
+
+	if resetter, ok := msg.(Resetter); ok {
+		resetter.Reset()
+	}
+	return decodeBody(r, msg, hdr, msgType, packetRemaining, config)
+}
+
+// DecodeConnect decodes one message from r, which must be a CONNECT, as the
+// first message a server receives on a connection should be. If it is not,
+// ErrUnexpectedMsgType is returned as for DecodeInto. The will and
+// credentials of the returned message are available from its Will and
+// Credentials methods. config is treated as for DecodeOneMessage.
+func DecodeConnect(r io.Reader, config DecoderConfig) (*Connect, error) {
+	msg := new(Connect)
+	if err := DecodeInto(r, msg, config); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// decodeBody decodes the remainder of a message into msg after its fixed
+// header has been decoded.
+func decodeBody(r io.Reader, msg Message, hdr Header, msgType MessageType, packetRemaining int32, config DecoderConfig) error {
 	if config == nil {
 		config = DefaultDecoderConfig{}
 	}
 
-	return msg, msg.Decode(r, hdr, packetRemaining, config)
+	opts := decodeOptions(config)
+	if opts.MaxRemainingLength > 0 && packetRemaining > opts.MaxRemainingLength {
+		return ErrPacketTooLarge
+	}
+
+	if opts.Strict {
+		if !msgType.validFixedHeaderFlags(hdr.flags(), true) {
+			return skipBody(r, packetRemaining, config, ErrInvalidFixedHeaderFlags)
+		}
+	}
+
+	if opts.ProtocolVersion >= 5 && !msgType.decodesVersion5() {
+		return skipBody(r, packetRemaining, config, ErrUnsupportedVersion)
+	}
+
+	return msg.Decode(r, hdr, packetRemaining, config)
+}
+
+// skipBody reads and discards the body of a message that cannot be decoded, so
+// that r is positioned at the start of the next message, and returns err. If
+// the body is longer than the configured MaxRemainingLength, it is left unread
+// and ErrPacketTooLarge is returned instead.
+func skipBody(r io.Reader, packetRemaining int32, config DecoderConfig, err error) error {
+	if max := decodeOptions(config).MaxRemainingLength; max > 0 && packetRemaining > max {
+		return ErrPacketTooLarge
+	}
+	io.CopyN(io.Discard, r, int64(packetRemaining))
+	return err
 }
 
 // NewMessage creates an instance of a Message value for the given message
-// type. An error is returned if msgType is invalid.
+// type. An error is returned if msgType is invalid and has not been registered
+// with RegisterMessage.
 func NewMessage(msgType MessageType) (msg Message, err error) {
 	switch msgType {
 	case MsgConnect:
@@ -202,12 +508,52 @@ func NewMessage(msgType MessageType) (msg Message, err error) {
 	case MsgDisconnect:
 		msg = new(Disconnect)
 	default:
-		return nil, badMsgTypeError
+		newMessage := registeredMessage(msgType)
+		if newMessage == nil {
+			return nil, ErrBadMsgType
+		}
+		msg = newMessage()
 	}
 
 	return
 }
 
+// messageTypeOf returns the message type of msg, or 0 if msg is not one of
+// the message types of this package.
+func messageTypeOf(msg Message) MessageType {
+	switch msg.(type) {
+	case *Connect:
+		return MsgConnect
+	case *ConnAck:
+		return MsgConnAck
+	case *Publish:
+		return MsgPublish
+	case *PubAck:
+		return MsgPubAck
+	case *PubRec:
+		return MsgPubRec
+	case *PubRel:
+		return MsgPubRel
+	case *PubComp:
+		return MsgPubComp
+	case *Subscribe:
+		return MsgSubscribe
+	case *SubAck:
+		return MsgSubAck
+	case *Unsubscribe:
+		return MsgUnsubscribe
+	case *UnsubAck:
+		return MsgUnsubAck
+	case *PingReq:
+		return MsgPingReq
+	case *PingResp:
+		return MsgPingResp
+	case *Disconnect:
+		return MsgDisconnect
+	}
+	return 0
+}
+
 // panicErr wraps an error that caused a problem that needs to bail out of the
 // API, such that errors can be recovered and returned as errors from the
 // public API.
@@ -224,8 +570,10 @@ func raiseError(err error) {
 }
 
 // recoverError recovers any panic in flight and, iff it's an error from
-// raiseError, will return the error. Otherwise re-raises the panic value.
-// If no panic is in flight, it returns existingErr.
+// raiseError, will return the error. Any other panic, such as a runtime error
+// caused by a bug, is returned as an error wrapping ErrInternal, so that
+// malformed input cannot crash the caller. If no panic is in flight, it
+// returns existingErr.
 //
 // This must be used in combination with a defer in all public API entry
 // points where raiseError could be called.
@@ -233,9 +581,8 @@ func recoverError(existingErr error, recovered interface{}) error {
 	if recovered != nil {
 		if pErr, ok := recovered.(panicErr); ok {
 			return pErr.err
-		} else {
-			panic(recovered)
 		}
+		return fmt.Errorf("%w: %v", ErrInternal, recovered)
 	}
 	return existingErr
 }
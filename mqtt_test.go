@@ -1,10 +1,19 @@
 package mqtt
 
 import (
+	"bufio"
 	"bytes"
+	"errors"
+	"hash/crc32"
 	"io"
+	"math/rand"
+	"net"
 	"reflect"
+	"runtime"
+	"strings"
 	"testing"
+	"testing/quick"
+	"time"
 
 	gbt "github.com/huin/gobinarytest"
 )
@@ -29,6 +38,24 @@ func (c fakeDecoderConfig) MakePayload(msg *Publish, r io.Reader, n int) (Payloa
 	return fakeSizePayload(n), nil
 }
 
+func TestMessagesImplementOptionalInterfaces(t *testing.T) {
+	for msgType := MsgConnect; msgType.IsValid(); msgType++ {
+		msg, err := NewMessage(msgType)
+		if err != nil {
+			t.Fatalf("Unexpected error creating message type %d: %v", msgType, err)
+		}
+		if _, ok := msg.(Resetter); !ok {
+			t.Errorf("%T does not implement Resetter", msg)
+		}
+		if _, ok := msg.(io.WriterTo); !ok {
+			t.Errorf("%T does not implement io.WriterTo", msg)
+		}
+		if _, ok := msg.(Sizer); !ok {
+			t.Errorf("%T does not implement Sizer", msg)
+		}
+	}
+}
+
 func TestEncodeDecode(t *testing.T) {
 	tests := []struct {
 		Comment       string
@@ -93,6 +120,18 @@ func TestEncodeDecode(t *testing.T) {
 			},
 		},
 
+		{
+			Comment: "CONNACK message with session present",
+			Msg:     NewConnAck(RetCodeAccepted, true),
+			Expected: gbt.InOrder{
+				gbt.Named{"Header byte", gbt.Literal{0x20}},
+				gbt.Named{"Remaining length", gbt.Literal{2}},
+
+				gbt.Named{"Acknowledge flags", gbt.Literal{0x01}},
+				gbt.Named{"Return code", gbt.Literal{0}},
+			},
+		},
+
 		{
 			Comment: "PUBLISH message with QoS = QosAtMostOnce",
 			Msg: &Publish{
@@ -179,9 +218,12 @@ func TestEncodeDecode(t *testing.T) {
 
 		{
 			Comment: "PUBREL message",
-			Msg:     &PubRel{MessageId: 0x1234},
+			Msg: &PubRel{
+				Header:    Header{QosLevel: QosAtLeastOnce},
+				MessageId: 0x1234,
+			},
 			Expected: gbt.InOrder{
-				gbt.Named{"Header byte", gbt.Literal{0x60}},
+				gbt.Named{"Header byte", gbt.Literal{0x62}},
 				gbt.Named{"Remaining length", gbt.Literal{2}},
 				gbt.Named{"MessageId", gbt.Literal{0x12, 0x34}},
 			},
@@ -316,6 +358,370 @@ func TestEncodeDecode(t *testing.T) {
 			} else if err = gbt.Matches(test.Expected, encodedBuf.Bytes()); err != nil {
 				t.Errorf("%s: Unexpected encoding output: %v", test.Comment, err)
 			}
+
+			// Test EncodedLen.
+			expectedLen := encodedBuf.Len()
+			if msg, ok := test.Msg.(*Publish); ok {
+				if payload, ok := msg.Payload.(fakeSizePayload); ok {
+					// The fake payload doesn't write its data.
+					expectedLen += int(payload)
+				}
+			}
+			if n, err := test.Msg.(Sizer).EncodedLen(); err != nil {
+				t.Errorf("%s: Unexpected error from EncodedLen: %v", test.Comment, err)
+			} else if n != expectedLen {
+				t.Errorf("%s: EncodedLen returned %d, expected %d", test.Comment, n, expectedLen)
+			}
+
+			if err := Validate(test.Msg); err != nil {
+				t.Errorf("%s: Unexpected error from Validate: %v", test.Comment, err)
+			}
+
+			// Test WriteTo.
+			writtenBuf := new(bytes.Buffer)
+			if n, err := test.Msg.(io.WriterTo).WriteTo(writtenBuf); err != nil {
+				t.Errorf("%s: Unexpected error during WriteTo: %v", test.Comment, err)
+			} else if n != int64(encodedBuf.Len()) {
+				t.Errorf("%s: WriteTo returned %d, expected %d", test.Comment, n, encodedBuf.Len())
+			} else if !bytes.Equal(encodedBuf.Bytes(), writtenBuf.Bytes()) {
+				t.Errorf("%s: WriteTo output differs from Encode", test.Comment)
+			}
+		}
+	}
+}
+
+// randomString returns a random string of up to maxLen characters, drawn from
+// alphabet.
+func randomString(r *rand.Rand, alphabet []rune, maxLen int) string {
+	s := make([]rune, r.Intn(maxLen+1))
+	for i := range s {
+		s[i] = alphabet[r.Intn(len(alphabet))]
+	}
+	return string(s)
+}
+
+var randomAlphabet = []rune("abcxyz0123/é€😀")
+
+// randomTopic returns a random valid topic name, or if filter is true, a
+// random valid topic filter.
+func randomTopic(r *rand.Rand, filter bool) string {
+	levels := make([]string, 1+r.Intn(4))
+	for i := range levels {
+		if filter && r.Intn(4) == 0 {
+			levels[i] = "+"
+		} else {
+			levels[i] = randomString(r, []rune("abcxyz0123é€"), 5)
+		}
+	}
+	if filter && r.Intn(4) == 0 {
+		levels[len(levels)-1] = "#"
+	}
+	if topic := strings.Join(levels, "/"); topic != "" {
+		return topic
+	}
+	return "a"
+}
+
+// randomMessageId returns a random non-zero message ID.
+func randomMessageId(r *rand.Rand) uint16 {
+	return uint16(1 + r.Intn(0xffff))
+}
+
+// randomUserProperties returns up to two random user properties, or nil.
+func randomUserProperties(r *rand.Rand) []UserProperty {
+	var props []UserProperty
+	for i := r.Intn(3); i > 0; i-- {
+		props = append(props, UserProperty{randomString(r, randomAlphabet, 8), randomString(r, randomAlphabet, 8)})
+	}
+	return props
+}
+
+// randomProperties returns random MQTT 5.0 PUBLISH properties, or if will is
+// true, random will properties, which exclude the Topic Alias and
+// Subscription Identifiers.
+func randomProperties(r *rand.Rand, will bool) *Properties {
+	p := new(Properties)
+	if r.Intn(2) == 0 {
+		v := uint8(r.Intn(2))
+		p.PayloadFormatIndicator = &v
+	}
+	if r.Intn(2) == 0 {
+		v := r.Uint32()
+		p.MessageExpiryInterval = &v
+	}
+	if !will && r.Intn(2) == 0 {
+		v := randomMessageId(r)
+		p.TopicAlias = &v
+	}
+	if r.Intn(2) == 0 {
+		v := randomTopic(r, false)
+		p.ResponseTopic = &v
+	}
+	if r.Intn(2) == 0 {
+		p.CorrelationData = []byte(randomString(r, randomAlphabet, 8) + "x")
+	}
+	if !will {
+		for i := r.Intn(3); i > 0; i-- {
+			p.SubscriptionIdentifiers = append(p.SubscriptionIdentifiers, uint32(1+r.Intn(maxVarInt)))
+		}
+	}
+	if r.Intn(2) == 0 {
+		v := randomString(r, randomAlphabet, 8)
+		p.ContentType = &v
+	}
+	p.UserProperties = randomUserProperties(r)
+	return p
+}
+
+// randomAckReason returns random MQTT 5.0 fields of an acknowledgement.
+func randomAckReason(r *rand.Rand) AckReason {
+	return AckReason{
+		ProtocolVersion: 5,
+		ReasonCode:      []ReasonCode{ReasonSuccess, 0x10, ReasonUnspecifiedError, 0x92}[r.Intn(4)],
+		ReasonString:    randomString(r, randomAlphabet, 8),
+		UserProperties:  randomUserProperties(r),
+	}
+}
+
+// randomMessage returns a random message of a random type, which is valid
+// such that it can be encoded and decodes to an equal value. If v5 is true,
+// the message is of a type that can be decoded for MQTT 5.0, and includes
+// random MQTT 5.0 fields such that it decodes to an equal value with
+// DecodeOptions.ProtocolVersion 5.
+func randomMessage(r *rand.Rand, v5 bool) Message {
+	msgType := MessageType(1 + r.Intn(14))
+	for v5 && !msgType.decodesVersion5() {
+		msgType = MessageType(1 + r.Intn(14))
+	}
+
+	switch msgType {
+	case MsgConnect:
+		msg := &Connect{ProtocolName: "MQTT", ProtocolVersion: 4}
+		if v5 {
+			msg.ProtocolVersion = 5
+		} else if r.Intn(2) == 0 {
+			msg.ProtocolName, msg.ProtocolVersion = "MQIsdp", 3
+		}
+		msg.CleanSession = r.Intn(2) == 0
+		msg.KeepAliveTimer = uint16(r.Intn(0x10000))
+		msg.ClientId = randomString(r, randomAlphabet, 23)
+		if v5 && r.Intn(2) == 0 {
+			v := r.Uint32()
+			msg.SessionExpiryInterval = &v
+		}
+		if r.Intn(2) == 0 {
+			msg.SetWill(&Will{
+				Topic:   randomTopic(r, false),
+				Message: []byte(randomString(r, randomAlphabet, 16)),
+				Qos:     QosLevel(r.Intn(3)),
+				Retain:  r.Intn(2) == 0,
+			})
+			if v5 {
+				msg.WillProperties = randomProperties(r, true)
+				if r.Intn(2) == 0 {
+					v := r.Uint32()
+					msg.WillDelayInterval = &v
+				}
+			}
+		}
+		if r.Intn(2) == 0 {
+			msg.UsernameFlag = true
+			msg.Username = randomString(r, randomAlphabet, 16)
+			if r.Intn(2) == 0 {
+				msg.PasswordFlag = true
+				msg.Password = randomString(r, randomAlphabet, 16)
+			}
+		}
+		return msg
+	case MsgConnAck:
+		if v5 {
+			rc := []ReasonCode{ReasonSuccess, ReasonUnspecifiedError, ReasonNotAuthorized, ReasonServerShuttingDown}[r.Intn(4)]
+			return NewConnAck(ReturnCode(rc), r.Intn(2) == 0)
+		}
+		return NewConnAck(ReturnCode(r.Intn(int(retCodeFirstInvalid))), r.Intn(2) == 0)
+	case MsgPublish:
+		msg := &Publish{
+			Header:    Header{QosLevel: QosLevel(r.Intn(3)), Retain: r.Intn(2) == 0},
+			TopicName: randomTopic(r, false),
+			Payload:   BytesPayload(randomString(r, randomAlphabet, 64)),
+		}
+		if msg.Header.QosLevel.HasId() {
+			msg.Header.DupFlag = r.Intn(2) == 0
+			msg.MessageId = randomMessageId(r)
+		}
+		if v5 {
+			msg.Properties = randomProperties(r, false)
+		}
+		return msg
+	case MsgPubAck:
+		msg := NewPubAck(randomMessageId(r))
+		if v5 {
+			msg.AckReason = randomAckReason(r)
+		}
+		return msg
+	case MsgPubRec:
+		msg := NewPubRec(randomMessageId(r))
+		if v5 {
+			msg.AckReason = randomAckReason(r)
+		}
+		return msg
+	case MsgPubRel:
+		msg := NewPubRel(randomMessageId(r))
+		if v5 {
+			msg.AckReason = randomAckReason(r)
+		}
+		return msg
+	case MsgPubComp:
+		msg := NewPubComp(randomMessageId(r))
+		if v5 {
+			msg.AckReason = randomAckReason(r)
+		}
+		return msg
+	case MsgSubscribe:
+		msg := &Subscribe{Header: Header{QosLevel: QosAtLeastOnce}, MessageId: randomMessageId(r)}
+		for i := r.Intn(4); i >= 0; i-- {
+			msg.Topics = append(msg.Topics, TopicQos{randomTopic(r, true), QosLevel(r.Intn(3))})
+		}
+		return msg
+	case MsgSubAck:
+		granted := make([]QosLevel, r.Intn(5))
+		for i := range granted {
+			granted[i] = []QosLevel{QosAtMostOnce, QosAtLeastOnce, QosExactlyOnce, SubAckFailure}[r.Intn(4)]
+		}
+		msg, _ := NewSubAck(randomMessageId(r), granted)
+		return msg
+	case MsgUnsubscribe:
+		msg := &Unsubscribe{Header: Header{QosLevel: QosAtLeastOnce}, MessageId: randomMessageId(r)}
+		for i := r.Intn(4); i >= 0; i-- {
+			msg.Topics = append(msg.Topics, randomTopic(r, true))
+		}
+		return msg
+	case MsgUnsubAck:
+		return NewUnsubAck(randomMessageId(r))
+	case MsgDisconnect:
+		if v5 {
+			return &Disconnect{
+				ProtocolVersion: 5,
+				ReasonCode:      []ReasonCode{ReasonSuccess, 0x04, ReasonUnspecifiedError, ReasonServerShuttingDown}[r.Intn(4)],
+				ReasonString:    randomString(r, randomAlphabet, 8),
+			}
+		}
+		return &Disconnect{}
+	default:
+		msg, _ := NewMessage(msgType)
+		return msg
+	}
+}
+
+func TestQuickRoundTrip(t *testing.T) {
+	roundTrip := func(seed int64, v5 bool) bool {
+		msg := randomMessage(rand.New(rand.NewSource(seed)), v5)
+		var config DecoderConfig
+		if v5 {
+			config = DecodeOptions{ProtocolVersion: 5}
+		}
+
+		encodedBuf := new(bytes.Buffer)
+		if err := msg.Encode(encodedBuf); err != nil {
+			t.Logf("Unexpected error encoding %#v: %v", msg, err)
+			return false
+		}
+		encoded := append([]byte{}, encodedBuf.Bytes()...)
+
+		decoded, err := DecodeOneMessage(encodedBuf, config)
+		if err != nil {
+			t.Logf("Unexpected error decoding %#v from %#v: %v", msg, encoded, err)
+			return false
+		}
+		if !reflect.DeepEqual(msg, decoded) {
+			t.Logf("Decoded value mismatch\n     got = %#v\nexpected = %#v", decoded, msg)
+			return false
+		}
+
+		reencodedBuf := new(bytes.Buffer)
+		if err := decoded.Encode(reencodedBuf); err != nil || !bytes.Equal(encoded, reencodedBuf.Bytes()) {
+			t.Logf("Re-encoded bytes mismatch for %#v: %v\n     got = %#v\nexpected = %#v", msg, err, reencodedBuf.Bytes(), encoded)
+			return false
+		}
+		return true
+	}
+
+	if err := quick.Check(roundTrip, &quick.Config{MaxCount: 5000}); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestDecodeEncodeGolden checks that decoding then re-encoding well-formed
+// messages of each type reproduces their bytes exactly.
+func TestDecodeEncodeGolden(t *testing.T) {
+	tests := []struct {
+		Comment string
+		Bytes   []byte
+	}{
+		{
+			Comment: "CONNECT with all fields",
+			Bytes: []byte{
+				0x10, 0x27,
+				0x00, 0x06, 'M', 'Q', 'I', 's', 'd', 'p', // Protocol name
+				0x03,       // Protocol version
+				0xee,       // Flags
+				0x00, 0x1e, // Keep alive timer
+				0x00, 0x03, 'c', 'i', 'd', // Client ID
+				0x00, 0x03, 'w', '/', 't', // Will topic
+				0x00, 0x04, 'w', 'i', 'l', 'l', // Will message
+				0x00, 0x04, 'n', 'a', 'm', 'e', // Username
+				0x00, 0x03, 'p', 'w', 'd', // Password
+			},
+		},
+		{
+			Comment: "CONNECT with no optional fields",
+			Bytes: []byte{
+				0x10, 0x0f,
+				0x00, 0x04, 'M', 'Q', 'T', 'T', // Protocol name
+				0x04,       // Protocol version
+				0x00,       // Flags
+				0x00, 0x00, // Keep alive timer
+				0x00, 0x03, 'c', 'i', 'd', // Client ID
+			},
+		},
+		{"CONNACK", []byte{0x20, 0x02, 0x01, 0x05}},
+		{"PUBLISH with QoS 0", []byte{0x31, 0x06, 0x00, 0x01, 'a', 0x01, 0x02, 0x03}},
+		{"PUBLISH with QoS 2", []byte{0x3c, 0x05, 0x00, 0x01, 'a', 0x12, 0x34}},
+		{"PUBACK", []byte{0x40, 0x02, 0x12, 0x34}},
+		{"PUBREC", []byte{0x50, 0x02, 0x12, 0x34}},
+		{"PUBREL", []byte{0x62, 0x02, 0x12, 0x34}},
+		{"PUBCOMP", []byte{0x70, 0x02, 0x12, 0x34}},
+		{"SUBSCRIBE", []byte{0x82, 0x0a, 0x43, 0x21, 0x00, 0x01, 'a', 0x01, 0x00, 0x01, 'b', 0x02}},
+		{"SUBSCRIBE with no topics", []byte{0x82, 0x02, 0x43, 0x21}},
+		{"SUBACK", []byte{0x90, 0x05, 0x43, 0x21, 0x00, 0x02, 0x80}},
+		{"SUBACK with no topics", []byte{0x90, 0x02, 0x43, 0x21}},
+		{"UNSUBSCRIBE", []byte{0xa2, 0x08, 0x43, 0x21, 0x00, 0x01, 'a', 0x00, 0x01, 'b'}},
+		{"UNSUBSCRIBE with no topics", []byte{0xa2, 0x02, 0x43, 0x21}},
+		{"UNSUBACK", []byte{0xb0, 0x02, 0x43, 0x21}},
+		{"PINGREQ", []byte{0xc0, 0x00}},
+		{"PINGRESP", []byte{0xd0, 0x00}},
+		{"DISCONNECT", []byte{0xe0, 0x00}},
+	}
+
+	for _, test := range tests {
+		msg, err := DecodeOneMessage(bytes.NewBuffer(test.Bytes), nil)
+		if err != nil {
+			t.Errorf("%s: Unexpected error during decoding: %v", test.Comment, err)
+			continue
+		}
+		encodedBuf := new(bytes.Buffer)
+		if err := msg.Encode(encodedBuf); err != nil {
+			t.Errorf("%s: Unexpected error during encoding %#v: %v", test.Comment, msg, err)
+		} else if !bytes.Equal(test.Bytes, encodedBuf.Bytes()) {
+			t.Errorf("%s: Encoded bytes mismatch\n     got = %#v\nexpected = %#v",
+				test.Comment, encodedBuf.Bytes(), test.Bytes)
+		}
+
+		if redecoded, err := DecodeOneMessage(encodedBuf, nil); err != nil {
+			t.Errorf("%s: Unexpected error during re-decoding: %v", test.Comment, err)
+		} else if !reflect.DeepEqual(msg, redecoded) {
+			t.Errorf("%s: Re-decoded value mismatch\n     got = %#v\nexpected = %#v",
+				test.Comment, redecoded, msg)
 		}
 	}
 }
@@ -324,6 +730,8 @@ func TestErrorEncode(t *testing.T) {
 	tests := []struct {
 		Comment string
 		Msg     Message
+		// Err is the specific error expected, if non-nil.
+		Err error
 	}{
 		{
 			Comment: "Payload reports Size() that's too large for MQTT payload.",
@@ -343,203 +751,3443 @@ func TestErrorEncode(t *testing.T) {
 				Payload:   fakeSizePayload(0x7fffffff),
 			},
 		},
-	}
-
-	for _, test := range tests {
-		encodedBuf := new(bytes.Buffer)
-		if err := test.Msg.Encode(encodedBuf); err == nil {
-			t.Errorf("%s: Expected error during encoding, but got nil.", test.Comment)
-		}
-	}
-}
-
-func TestErrorDecode(t *testing.T) {
-	tests := []struct {
-		Comment  string
-		Expected gbt.Matcher
-	}{
 		{
-			Comment:  "Immediate EOF",
-			Expected: gbt.Literal{},
+			Comment: "PUBLISH with a wildcard in its topic name.",
+			Msg:     &Publish{TopicName: "a/#", Payload: BytesPayload{}},
+			Err:     ErrInvalidTopicName,
 		},
 		{
-			Comment:  "EOF at 1 byte",
-			Expected: gbt.Literal{0x10},
+			Comment: "PUBLISH with a wildcard within its topic name.",
+			Msg:     &Publish{TopicName: "a/#/b", Payload: BytesPayload{}},
+			Err:     ErrWildcardInTopicName,
 		},
 		{
-			Comment: "PUBACK message with too short a length",
-			Expected: gbt.InOrder{
-				gbt.Named{"Header byte", gbt.Literal{0x40}},
-				gbt.Named{"Remaining length", gbt.Literal{1}},
-
-				gbt.Named{"Truncated MessageId", gbt.Literal{0x12}},
+			Comment: "PUBLISH with an empty topic name.",
+			Msg:     &Publish{Payload: BytesPayload{}},
+			Err:     ErrInvalidTopicName,
+		},
+		{
+			Comment: "SUBSCRIBE with '#' before the last level.",
+			Msg: &Subscribe{
+				Header:    Header{QosLevel: QosAtLeastOnce},
+				MessageId: 0x1234,
+				Topics:    []TopicQos{{"a/#/b", QosAtMostOnce}},
 			},
+			Err: ErrInvalidTopicFilter,
 		},
 		{
-			Comment: "PUBACK message with too long a length",
-			Expected: gbt.InOrder{
-				gbt.Named{"Header byte", gbt.Literal{0x40}},
-				gbt.Named{"Remaining length", gbt.Literal{3}},
-
-				gbt.Named{"Truncated MessageId", gbt.Literal{0x12, 0x34, 0x56}},
+			Comment: "UNSUBSCRIBE with '+' in part of a level.",
+			Msg: &Unsubscribe{
+				Header:    Header{QosLevel: QosAtLeastOnce},
+				MessageId: 0x1234,
+				Topics:    []string{"a/+b"},
+			},
+			Err: ErrInvalidTopicFilter,
+		},
+		{
+			Comment: "PUBLISH with QoS = QosAtMostOnce and DupFlag set.",
+			Msg: &Publish{
+				Header:    Header{DupFlag: true, QosLevel: QosAtMostOnce},
+				TopicName: "a/b",
+				Payload:   BytesPayload{1, 2, 3},
+			},
+			Err: ErrDupOnQos0,
+		},
+		{
+			Comment: "PUBLISH with QoS = QosAtLeastOnce and a zero MessageId.",
+			Msg: &Publish{
+				Header:    Header{QosLevel: QosAtLeastOnce},
+				TopicName: "a/b",
+				Payload:   BytesPayload{1, 2, 3},
+			},
+			Err: ErrMissingMessageId,
+		},
+		{"PUBACK with a zero MessageId.", &PubAck{}, ErrMissingMessageId},
+		{"PUBREL with a zero MessageId.", &PubRel{Header: Header{QosLevel: QosAtLeastOnce}}, ErrMissingMessageId},
+		{
+			Comment: "SUBSCRIBE with a zero MessageId.",
+			Msg: &Subscribe{
+				Header: Header{QosLevel: QosAtLeastOnce},
+				Topics: []TopicQos{{"a/b", QosAtLeastOnce}},
+			},
+			Err: ErrMissingMessageId,
+		},
+		{"SUBACK with a zero MessageId.", &SubAck{TopicsQos: []QosLevel{QosAtLeastOnce}}, ErrMissingMessageId},
+		{
+			Comment: "UNSUBSCRIBE with a zero MessageId.",
+			Msg:     &Unsubscribe{Header: Header{QosLevel: QosAtLeastOnce}, Topics: []string{"a/b"}},
+			Err:     ErrMissingMessageId,
+		},
+		{"UNSUBACK with a zero MessageId.", &UnsubAck{}, ErrMissingMessageId},
+		{
+			Comment: "PUBLISH with a topic longer than 65535 bytes.",
+			Msg: &Publish{
+				TopicName: strings.Repeat("a", 70000),
+				Payload:   BytesPayload{1, 2, 3},
+			},
+			Err: ErrStringTooLong,
+		},
+		{
+			Comment: "PUBLISH with a topic containing U+0000.",
+			Msg: &Publish{
+				TopicName: "a/\x00/b",
+				Payload:   BytesPayload{1, 2, 3},
+			},
+			Err: ErrInvalidString,
+		},
+		{
+			Comment: "PUBLISH with a nil payload and a topic containing U+0000.",
+			Msg:     &Publish{TopicName: "a/\x00/b"},
+			Err:     ErrInvalidString,
+		},
+		{
+			Comment: "PUBLISH with a topic containing invalid UTF-8.",
+			Msg: &Publish{
+				TopicName: "a/\xff/b",
+				Payload:   BytesPayload{1, 2, 3},
+			},
+			Err: ErrInvalidString,
+		},
+		{
+			Comment: "SUBSCRIBE with a topic containing a non-character.",
+			Msg: &Subscribe{
+				Header:    Header{QosLevel: QosAtLeastOnce},
+				MessageId: 0x4321,
+				Topics:    []TopicQos{{"a/\ufffe", QosAtLeastOnce}},
+			},
+			Err: ErrInvalidString,
+		},
+		{
+			Comment: "UNSUBSCRIBE with a topic longer than 65535 bytes.",
+			Msg: &Unsubscribe{
+				Header:    Header{QosLevel: QosAtLeastOnce},
+				MessageId: 0x4321,
+				Topics:    []string{strings.Repeat("a", 70000)},
+			},
+			Err: ErrStringTooLong,
+		},
+		{
+			Comment: "CONNECT with a client identifier containing U+0000.",
+			Msg:     &Connect{ProtocolName: "MQIsdp", ProtocolVersion: 3, ClientId: "a\x00"},
+			Err:     ErrInvalidString,
+		},
+		{
+			Comment: "CONNECT with a password longer than 65535 bytes.",
+			Msg: &Connect{
+				ProtocolName:    "MQIsdp",
+				ProtocolVersion: 3,
+				UsernameFlag:    true,
+				PasswordFlag:    true,
+				Username:        "name",
+				Password:        strings.Repeat("a", 70000),
 			},
+			Err: ErrStringTooLong,
+		},
+		{
+			Comment: "CONNECT with protocol name MQTT and version 3.",
+			Msg:     &Connect{ProtocolName: "MQTT", ProtocolVersion: 3},
+			Err:     ErrProtocolMismatch,
+		},
+		{
+			Comment: "CONNECT with will QoS set without the will flag.",
+			Msg:     &Connect{ProtocolName: "MQIsdp", ProtocolVersion: 3, WillQos: QosAtLeastOnce},
+			Err:     ErrWillWithoutFlag,
+		},
+		{
+			Comment: "CONNECT with will retain set without the will flag.",
+			Msg:     &Connect{ProtocolName: "MQIsdp", ProtocolVersion: 3, WillRetain: true},
+			Err:     ErrWillWithoutFlag,
+		},
+		{
+			Comment: "CONNECT with a Will Delay Interval set without the will flag.",
+			Msg:     &Connect{ProtocolName: "MQTT", ProtocolVersion: 5, WillDelayInterval: new(uint32)},
+			Err:     ErrWillWithoutFlag,
+		},
+		{
+			Comment: "CONNECT with a password but no username.",
+			Msg:     &Connect{ProtocolName: "MQTT", ProtocolVersion: 4, PasswordFlag: true, Password: "pwd"},
+			Err:     ErrPasswordWithoutUsername,
+		},
+		{
+			Comment: "CONNECT with protocol name MQIsdp and version 4.",
+			Msg:     &Connect{ProtocolName: "MQIsdp", ProtocolVersion: 4},
+			Err:     ErrProtocolMismatch,
+		},
+		{
+			Comment: "MQTT 3.1.1 CONNECT with a Session Expiry Interval.",
+			Msg:     &Connect{ProtocolName: "MQTT", ProtocolVersion: 4, SessionExpiryInterval: new(uint32)},
+			Err:     ErrUnsupportedVersion,
+		},
+		{
+			Comment: "MQTT 3.1.1 CONNECT with will properties.",
+			Msg:     &Connect{ProtocolName: "MQTT", ProtocolVersion: 4, WillFlag: true, WillProperties: &Properties{}},
+			Err:     ErrUnsupportedVersion,
+		},
+		{
+			Comment: "CONNECT with a Topic Alias in the will properties.",
+			Msg: &Connect{ProtocolName: "MQTT", ProtocolVersion: 5, WillFlag: true,
+				WillProperties: &Properties{TopicAlias: new(uint16)}},
+			Err: ErrBadProperty,
 		},
 	}
 
 	for _, test := range tests {
-		expectedBuf := new(bytes.Buffer)
-		test.Expected.Write(expectedBuf)
+		encodedBuf := new(bytes.Buffer)
+		err := test.Msg.Encode(encodedBuf)
+		if err == nil {
+			t.Errorf("%s: Expected error during encoding, but got nil.", test.Comment)
+		} else if test.Err != nil && !errors.Is(err, test.Err) {
+			t.Errorf("%s: Expected error %v, got %v", test.Comment, test.Err, err)
+		}
 
-		if _, err := DecodeOneMessage(expectedBuf, nil); err == nil {
-			t.Errorf("%s: Expected error during decoding, but got nil.", test.Comment)
+		if _, lenErr := test.Msg.(Sizer).EncodedLen(); lenErr != err {
+			t.Errorf("%s: EncodedLen returned error %v, Encode returned %v", test.Comment, lenErr, err)
+		}
+		if validateErr := Validate(test.Msg); validateErr != err {
+			t.Errorf("%s: Validate returned error %v, Encode returned %v", test.Comment, validateErr, err)
 		}
 	}
 }
 
-func TestLengthEncodeDecode(t *testing.T) {
-	tests := []struct {
-		Value   int32
-		Encoded gbt.Matcher
-	}{
-		{0, gbt.Literal{0}},
-		{1, gbt.Literal{1}},
-		{20, gbt.Literal{20}},
+// TestPublishNilPayload checks that a Publish with a nil Payload validates and
+// encodes in the same way as one with an empty payload.
+func TestPublishNilPayload(t *testing.T) {
+	msg := &Publish{TopicName: "a"}
+	if err := Validate(msg); err != nil {
+		t.Errorf("Unexpected error from Validate: %v", err)
+	}
 
-		// Boundary conditions used as tests taken from MQTT 3.1 spec.
-		{0, gbt.Literal{0x00}},
-		{127, gbt.Literal{0x7F}},
-		{128, gbt.Literal{0x80, 0x01}},
-		{16383, gbt.Literal{0xFF, 0x7F}},
-		{16384, gbt.Literal{0x80, 0x80, 0x01}},
-		{2097151, gbt.Literal{0xFF, 0xFF, 0x7F}},
-		{2097152, gbt.Literal{0x80, 0x80, 0x80, 0x01}},
-		{268435455, gbt.Literal{0xFF, 0xFF, 0xFF, 0x7F}},
+	expected := new(bytes.Buffer)
+	if err := (&Publish{TopicName: "a", Payload: BytesPayload{}}).Encode(expected); err != nil {
+		t.Fatalf("Unexpected error encoding empty payload: %v", err)
+	}
+	encodedBuf := new(bytes.Buffer)
+	if err := msg.Encode(encodedBuf); err != nil {
+		t.Errorf("Unexpected error during encoding: %v", err)
+	} else if !bytes.Equal(encodedBuf.Bytes(), expected.Bytes()) {
+		t.Errorf("Encoded % x, expected % x", encodedBuf.Bytes(), expected.Bytes())
+	}
+	if n, err := msg.EncodedLen(); err != nil {
+		t.Errorf("Unexpected error from EncodedLen: %v", err)
+	} else if n != expected.Len() {
+		t.Errorf("EncodedLen returned %d, expected %d", n, expected.Len())
 	}
+}
 
-	for _, test := range tests {
-		{
-			// Test decoding.
-			buf := new(bytes.Buffer)
-			test.Encoded.Write(buf)
-			buf = bytes.NewBuffer(buf.Bytes())
-			if result := decodeLength(buf); test.Value != result {
+func TestEncodeBinaryPassword(t *testing.T) {
+	msg := &Connect{
+		ProtocolName:    "MQIsdp",
+		ProtocolVersion: 3,
+		UsernameFlag:    true,
+		PasswordFlag:    true,
+		Username:        "name",
+		Password:        "\x00\xff",
+	}
+	encodedBuf := new(bytes.Buffer)
+	if err := msg.Encode(encodedBuf); err != nil {
+		t.Fatalf("Unexpected error during encoding: %v", err)
+	}
+	if !bytes.HasSuffix(encodedBuf.Bytes(), []byte{0x00, 0x02, 0x00, 0xff}) {
+		t.Errorf("Password not encoded as binary data: %#v", encodedBuf.Bytes())
+	}
+
+	decoded, err := DecodeOneMessage(encodedBuf, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error during decoding: %v", err)
+	}
+	if !reflect.DeepEqual(msg, decoded) {
+		t.Errorf("Decoded value mismatch\n     got = %#v\nexpected = %#v", decoded, msg)
+	}
+}
+
+func TestEncodeBinaryWillMessage(t *testing.T) {
+	msg := &Connect{ProtocolName: "MQTT", ProtocolVersion: 4}
+	msg.SetWill(&Will{Topic: "status", Message: []byte{0xff, 0x00, 0xff}})
+
+	encodedBuf := new(bytes.Buffer)
+	if err := msg.Encode(encodedBuf); err != nil {
+		t.Fatalf("Unexpected error during encoding: %v", err)
+	}
+	if !bytes.HasSuffix(encodedBuf.Bytes(), []byte{0x00, 0x03, 0xff, 0x00, 0xff}) {
+		t.Errorf("Will message not encoded as binary data: %#v", encodedBuf.Bytes())
+	}
+
+	decoded, err := DecodeOneMessage(encodedBuf, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error during decoding: %v", err)
+	}
+	if !reflect.DeepEqual(msg, decoded) {
+		t.Errorf("Decoded value mismatch\n     got = %#v\nexpected = %#v", decoded, msg)
+	}
+	if will, ok := decoded.(*Connect).Will(); !ok || !bytes.Equal(will.Message, []byte{0xff, 0x00, 0xff}) {
+		t.Errorf("Will() = %#v, %t, expected message %#v", will, ok, []byte{0xff, 0x00, 0xff})
+	}
+}
+
+func TestConnectCredentials(t *testing.T) {
+	encoded := []byte{
+		0x10, 0x18,
+		0x00, 0x06, 'M', 'Q', 'I', 's', 'd', 'p', // Protocol name
+		0x03,       // Protocol version
+		0xc0,       // Flags: username and password
+		0x00, 0x00, // Keep alive timer
+		0x00, 0x01, 'c', // Client ID
+		0x00, 0x02, 'u', 'n', // Username
+		0x00, 0x03, 0xff, 0x00, 0xfe, // Password
+	}
+	msg, err := DecodeOneMessage(bytes.NewBuffer(encoded), nil)
+	if err != nil {
+		t.Fatalf("Unexpected error during decoding: %v", err)
+	}
+
+	username, password, ok := msg.(*Connect).Credentials()
+	if !ok || username != "un" || !bytes.Equal(password, []byte{0xff, 0x00, 0xfe}) {
+		t.Errorf("Expected (%q, %#v, true), got (%q, %#v, %t)", "un", []byte{0xff, 0x00, 0xfe}, username, password, ok)
+	}
+
+	noCredentials := &Connect{Username: "ignored", Password: "ignored"}
+	if username, password, ok := noCredentials.Credentials(); ok || username != "" || password != nil {
+		t.Errorf("Expected no credentials, got (%q, %#v, %t)", username, password, ok)
+	}
+}
+
+func TestEncodeProtocolVersions(t *testing.T) {
+	tests := []struct {
+		Name    string
+		Version uint8
+	}{
+		{"MQIsdp", 3},
+		{"MQTT", 4},
+		{"MQTT", 5},
+		{"SomethingElse", 1},
+	}
+
+	for _, test := range tests {
+		msg := &Connect{ProtocolName: test.Name, ProtocolVersion: test.Version}
+		if err := msg.Encode(new(bytes.Buffer)); err != nil {
+			t.Errorf("%s/%d: Unexpected error during encoding: %v", test.Name, test.Version, err)
+		}
+	}
+}
+
+func TestEncodeFixedHeaderFlags(t *testing.T) {
+	tests := []struct {
+		Comment string
+		Msg     Message
+		// Flags is the required value of the lower 4 bits of the header byte.
+		Flags byte
+		// DupAllowed is true if DUP may also be set, as MQTT 3.1 allows.
+		DupAllowed bool
+	}{
+		{"CONNECT", &Connect{ProtocolName: "MQIsdp", ProtocolVersion: 3}, 0x0, false},
+		{"CONNACK", &ConnAck{}, 0x0, false},
+		{"PUBACK", &PubAck{MessageId: 1}, 0x0, false},
+		{"PUBREC", &PubRec{MessageId: 1}, 0x0, false},
+		{"PUBREL", &PubRel{MessageId: 1}, 0x2, true},
+		{"PUBCOMP", &PubComp{MessageId: 1}, 0x0, false},
+		{"SUBSCRIBE", &Subscribe{MessageId: 1, Topics: []TopicQos{{"a/b", QosAtMostOnce}}}, 0x2, true},
+		{"SUBACK", &SubAck{MessageId: 1, TopicsQos: []QosLevel{QosAtMostOnce}}, 0x0, false},
+		{"UNSUBSCRIBE", &Unsubscribe{MessageId: 1, Topics: []string{"a/b"}}, 0x2, true},
+		{"UNSUBACK", &UnsubAck{MessageId: 1}, 0x0, false},
+		{"PINGREQ", &PingReq{}, 0x0, false},
+		{"PINGRESP", &PingResp{}, 0x0, false},
+		{"DISCONNECT", &Disconnect{}, 0x0, false},
+	}
+
+	for _, test := range tests {
+		hdr := reflect.ValueOf(test.Msg).Elem().FieldByName("Header").Addr().Interface().(*Header)
+
+		for flags := byte(0); flags < 0x10; flags++ {
+			*hdr = Header{
+				DupFlag:  flags&0x08 > 0,
+				QosLevel: QosLevel(flags & 0x06 >> 1),
+				Retain:   flags&0x01 > 0,
+			}
+			if !hdr.QosLevel.IsValid() {
+				continue
+			}
+
+			encodedBuf := new(bytes.Buffer)
+			err := test.Msg.Encode(encodedBuf)
+			if flags == test.Flags || (test.DupAllowed && flags == test.Flags|0x08) {
+				if err != nil {
+					t.Errorf("%s with flags %#x: Unexpected error during encoding: %v", test.Comment, flags, err)
+				} else if got := encodedBuf.Bytes()[0] & 0x0f; got != flags {
+					t.Errorf("%s with flags %#x: Encoded flags %#x", test.Comment, flags, got)
+				}
+			} else if !errors.Is(err, ErrInvalidFixedHeaderFlags) {
+				t.Errorf("%s with flags %#x: Expected error %v, got %v", test.Comment, flags, ErrInvalidFixedHeaderFlags, err)
+			}
+		}
+	}
+}
+
+func TestErrorDecode(t *testing.T) {
+	tests := []struct {
+		Comment  string
+		Expected gbt.Matcher
+		// Err is the specific error expected, if non-nil.
+		Err error
+	}{
+		{
+			Comment:  "Immediate EOF",
+			Expected: gbt.Literal{},
+		},
+		{
+			Comment:  "EOF at 1 byte",
+			Expected: gbt.Literal{0x10},
+		},
+		{
+			Comment: "PUBACK message with too short a length",
+			Expected: gbt.InOrder{
+				gbt.Named{"Header byte", gbt.Literal{0x40}},
+				gbt.Named{"Remaining length", gbt.Literal{1}},
+
+				gbt.Named{"Truncated MessageId", gbt.Literal{0x12}},
+			},
+		},
+		{
+			Comment: "PUBACK message with too long a length",
+			Expected: gbt.InOrder{
+				gbt.Named{"Header byte", gbt.Literal{0x40}},
+				gbt.Named{"Remaining length", gbt.Literal{3}},
+
+				gbt.Named{"MessageId", gbt.Literal{0x12, 0x34}},
+				gbt.Named{"Extra byte", gbt.Literal{0x56}},
+			},
+			Err: ErrTrailingBytes,
+		},
+		{
+			Comment: "CONNECT message with UsernameFlag set but no username",
+			Expected: gbt.InOrder{
+				gbt.Named{"Header byte", gbt.Literal{0x10}},
+				gbt.Named{"Remaining length", gbt.Literal{12 + 3}},
+
+				gbt.Named{"Protocol name", gbt.InOrder{gbt.Literal{0x00, 0x06}, gbt.Literal("MQIsdp")}},
+				gbt.Named{
+					"Extended headers for CONNECT",
+					gbt.Literal{
+						0x03,       // Protocol version number
+						0x82,       // Connect flags (UsernameFlag, CleanSession)
+						0x00, 0x0a, // Keep alive timer
+					},
+				},
+				gbt.Named{"Client identifier", gbt.InOrder{gbt.Literal{0x00, 0x01}, gbt.Literal("c")}},
+			},
+			Err: ErrConnectPayloadMismatch,
+		},
+		{
+			Comment: "CONNECT message with unexpected trailing bytes",
+			Expected: gbt.InOrder{
+				gbt.Named{"Header byte", gbt.Literal{0x10}},
+				gbt.Named{"Remaining length", gbt.Literal{12 + 3 + 6}},
+
+				gbt.Named{"Protocol name", gbt.InOrder{gbt.Literal{0x00, 0x06}, gbt.Literal("MQIsdp")}},
+				gbt.Named{
+					"Extended headers for CONNECT",
+					gbt.Literal{
+						0x03,       // Protocol version number
+						0x02,       // Connect flags (CleanSession)
+						0x00, 0x0a, // Keep alive timer
+					},
+				},
+				gbt.Named{"Client identifier", gbt.InOrder{gbt.Literal{0x00, 0x01}, gbt.Literal("c")}},
+				gbt.Named{"Unflagged username", gbt.InOrder{gbt.Literal{0x00, 0x04}, gbt.Literal("name")}},
+			},
+			Err: ErrConnectPayloadMismatch,
+		},
+		{
+			Comment: "PINGREQ message with QoS = 3 in the fixed header",
+			Expected: gbt.InOrder{
+				gbt.Named{"Header byte", gbt.Literal{0xc6}},
+				gbt.Named{"Remaining length", gbt.Literal{0}},
+			},
+			Err: ErrBadQos,
+		},
+		{
+			Comment: "Remaining length with the continuation bit set on its fourth byte",
+			Expected: gbt.InOrder{
+				gbt.Named{"Header byte", gbt.Literal{0x30}},
+				gbt.Named{"Remaining length", gbt.Literal{0xff, 0xff, 0xff, 0xff}},
+				gbt.Named{"Next byte", gbt.Literal{0x01}},
+			},
+			Err: ErrBadLengthEncoding,
+		},
+		{
+			Comment: "PUBLISH message with QoS = 3 in the fixed header",
+			Expected: gbt.InOrder{
+				gbt.Named{"Header byte", gbt.Literal{0x36}},
+				gbt.Named{"Remaining length", gbt.Literal{5 + 2 + 3}},
+
+				gbt.Named{"Topic", gbt.Literal{0x00, 0x03, 'a', '/', 'b'}},
+				gbt.Named{"MessageId", gbt.Literal{0x12, 0x34}},
+				gbt.Named{"Data", gbt.Literal{1, 2, 3}},
+			},
+			Err: ErrBadQos,
+		},
+	}
+
+	for _, test := range tests {
+		expectedBuf := new(bytes.Buffer)
+		test.Expected.Write(expectedBuf)
+
+		if _, err := DecodeOneMessage(expectedBuf, nil); err == nil {
+			t.Errorf("%s: Expected error during decoding, but got nil.", test.Comment)
+		} else if test.Err != nil && !errors.Is(err, test.Err) {
+			t.Errorf("%s: Expected error %v, got %v", test.Comment, test.Err, err)
+		}
+	}
+}
+
+func TestPublishDecodeBadQos(t *testing.T) {
+	// Message.Decode can be called with a Header that did not come from
+	// Header.Decode, so Publish must check the QoS itself.
+	body := []byte{0x00, 0x03, 'a', '/', 'b', 0x12, 0x34, 1, 2, 3}
+	msg := new(Publish)
+	err := msg.Decode(bytes.NewBuffer(body), Header{QosLevel: 3}, int32(len(body)), DefaultDecoderConfig{})
+	if !errors.Is(err, ErrBadQos) {
+		t.Errorf("Expected error %v, got %v", ErrBadQos, err)
+	}
+}
+
+// TestDecodeBadQosSkipsBody checks that a message with invalid QoS bits is
+// skipped, so that the following message can be decoded.
+func TestDecodeBadQosSkipsBody(t *testing.T) {
+	encoded := []byte{0x36, 0x02, 0x00, 0x00, 0xc0, 0x00}
+	decoders := []struct {
+		Comment string
+		Decode  func(r io.Reader) (Message, error)
+	}{
+		{"DecodeOneMessage", func(r io.Reader) (Message, error) { return DecodeOneMessage(r, nil) }},
+		{"DecodeInto", func(r io.Reader) (Message, error) {
+			msg := new(PingReq)
+			return msg, DecodeInto(r, msg, nil)
+		}},
+	}
+
+	for _, test := range decoders {
+		buf := bytes.NewBuffer(encoded)
+		if _, err := test.Decode(buf); !errors.Is(err, ErrBadQos) {
+			t.Errorf("%s: Expected error %v, got %v", test.Comment, ErrBadQos, err)
+		}
+		if msg, err := test.Decode(buf); err != nil || !reflect.DeepEqual(msg, &PingReq{}) {
+			t.Errorf("%s: Expected PINGREQ after bad QoS, got %#v, %v", test.Comment, msg, err)
+		}
+	}
+
+	d := NewDecoder(bytes.NewBuffer(encoded))
+	if _, err := d.Decode(); !errors.Is(err, ErrBadQos) {
+		t.Errorf("Decoder: Expected error %v, got %v", ErrBadQos, err)
+	}
+	if msg, err := d.Decode(); err != nil || !reflect.DeepEqual(msg, &PingReq{}) {
+		t.Errorf("Decoder: Expected PINGREQ after bad QoS, got %#v, %v", msg, err)
+	}
+}
+
+func TestDecodeReservedMessageType(t *testing.T) {
+	for _, hdrByte := range []byte{0x00, 0xf0} {
+		buf := bytes.NewBuffer([]byte{
+			hdrByte, 0x02, 0x12, 0x34, // Reserved message type with a body.
+			0xc0, 0x00, // PINGREQ.
+		})
+
+		if _, err := DecodeOneMessage(buf, nil); !errors.Is(err, ErrBadMsgType) {
+			t.Errorf("Header byte %#x: Expected error %v, got %v", hdrByte, ErrBadMsgType, err)
+		}
+
+		// The body of the reserved message should have been skipped.
+		if msg, err := DecodeOneMessage(buf, nil); err != nil {
+			t.Errorf("Header byte %#x: Unexpected error decoding following message: %v", hdrByte, err)
+		} else if _, ok := msg.(*PingReq); !ok {
+			t.Errorf("Header byte %#x: Expected following *PingReq, got %#v", hdrByte, msg)
+		}
+	}
+}
+
+// TestConnectProperties checks that the properties of an MQTT 5.0 CONNECT are
+// skipped when decoding, and that an unknown property is rejected.
+func TestConnectProperties(t *testing.T) {
+	connect := func(props, willProps []byte) []byte {
+		body := []byte{0x00, 0x04, 'M', 'Q', 'T', 'T', 0x05, 0x04, 0x00, 0x0a}
+		body = append(body, byte(len(props)))
+		body = append(body, props...)
+		body = append(body, 0x00, 0x03, 'c', 'i', 'd')
+		body = append(body, byte(len(willProps)))
+		body = append(body, willProps...)
+		body = append(body, 0x00, 0x01, 't', 0x00, 0x01, 'm')
+		return append([]byte{0x10, byte(len(body))}, body...)
+	}
+	sessionExpiry, willDelay, contentType := uint32(60), uint32(5), "c"
+	expected := &Connect{
+		ProtocolName:          "MQTT",
+		ProtocolVersion:       5,
+		WillFlag:              true,
+		KeepAliveTimer:        10,
+		ClientId:              "cid",
+		WillTopic:             "t",
+		WillMessage:           "m",
+		SessionExpiryInterval: &sessionExpiry,
+		WillProperties:        &Properties{ContentType: &contentType},
+		WillDelayInterval:     &willDelay,
+	}
+
+	props := []byte{
+		0x11, 0x00, 0x00, 0x00, 0x3c, // Session Expiry Interval
+		0x21, 0x00, 0x10, // Receive Maximum
+		0x26, 0x00, 0x01, 'k', 0x00, 0x01, 'v', // User Property
+		0x15, 0x00, 0x01, 'x', // Authentication Method
+	}
+	willProps := []byte{
+		0x18, 0x00, 0x00, 0x00, 0x05, // Will Delay Interval
+		0x03, 0x00, 0x01, 'c', // Content Type
+	}
+	msg, err := DecodeOneMessage(bytes.NewBuffer(connect(props, willProps)), nil)
+	if err != nil {
+		t.Fatalf("Unexpected error during decoding: %v", err)
+	}
+	if !reflect.DeepEqual(msg, expected) {
+		t.Errorf("Decoded value mismatch\n     got = %#v\nexpected = %#v", msg, expected)
+	}
+
+	tests := []struct {
+		Comment          string
+		Props, WillProps []byte
+	}{
+		{"Topic Alias in the CONNECT properties", []byte{0x23, 0x00, 0x01}, nil},
+		{"Session Expiry Interval in the will properties", nil, []byte{0x11, 0x00, 0x00, 0x00, 0x3c}},
+		{"repeated Session Expiry Interval", []byte{0x11, 0x00, 0x00, 0x00, 0x3c, 0x11, 0x00, 0x00, 0x00, 0x3c}, nil},
+		{"repeated Will Delay Interval", nil, []byte{0x18, 0x00, 0x00, 0x00, 0x05, 0x18, 0x00, 0x00, 0x00, 0x05}},
+		{"Subscription Identifier in the will properties", nil, []byte{0x0b, 0x01}},
+	}
+	for _, test := range tests {
+		_, err := DecodeOneMessage(bytes.NewBuffer(connect(test.Props, test.WillProps)), nil)
+		if !errors.Is(err, ErrBadProperty) {
+			t.Errorf("%s: Expected ErrBadProperty, got %v", test.Comment, err)
+		}
+	}
+}
+
+func TestConnectWillAsPublish(t *testing.T) {
+	willProps := []byte{
+		0x18, 0x00, 0x00, 0x00, 0x05, // Will Delay Interval
+		0x01, 0x01, // Payload Format Indicator
+		0x03, 0x00, 0x04, 't', 'e', 'x', 't', // Content Type
+		0x08, 0x00, 0x01, 'r', // Response Topic
+		0x09, 0x00, 0x02, 0xca, 0xfe, // Correlation Data
+		0x26, 0x00, 0x01, 'k', 0x00, 0x01, 'v', // User Property
+	}
+	body := []byte{0x00, 0x04, 'M', 'Q', 'T', 'T', 0x05, 0x2c, 0x00, 0x0a, 0x00, 0x00, 0x03, 'c', 'i', 'd'}
+	body = append(body, byte(len(willProps)))
+	body = append(body, willProps...)
+	body = append(body, 0x00, 0x04, 'w', 'i', 'l', 'l', 0x00, 0x03, 'b', 'y', 'e')
+	msg, err := DecodeOneMessage(bytes.NewBuffer(append([]byte{0x10, byte(len(body))}, body...)), nil)
+	if err != nil {
+		t.Fatalf("Unexpected error during decoding: %v", err)
+	}
+
+	publish := msg.(*Connect).WillAsPublish()
+	publish.MessageId = 1
+	encodedBuf := new(bytes.Buffer)
+	if err := publish.Encode(encodedBuf); err != nil {
+		t.Fatalf("Unexpected error during encoding: %v", err)
+	}
+	expected := []byte{
+		0x33, 0x25, // QoS 1 and retained
+		0x00, 0x04, 'w', 'i', 'l', 'l',
+		0x00, 0x01,
+		0x19,       // Property Length
+		0x01, 0x01, // Payload Format Indicator
+		0x08, 0x00, 0x01, 'r', // Response Topic
+		0x09, 0x00, 0x02, 0xca, 0xfe, // Correlation Data
+		0x03, 0x00, 0x04, 't', 'e', 'x', 't', // Content Type
+		0x26, 0x00, 0x01, 'k', 0x00, 0x01, 'v', // User Property
+		'b', 'y', 'e',
+	}
+	if !bytes.Equal(encodedBuf.Bytes(), expected) {
+		t.Errorf("Encoded value mismatch\n     got = %#v\nexpected = %#v", encodedBuf.Bytes(), expected)
+	}
+
+	if publish := (&Connect{ProtocolName: "MQTT", ProtocolVersion: 4}).WillAsPublish(); publish != nil {
+		t.Errorf("Expected nil without a will, got %#v", publish)
+	}
+}
+
+func TestConnectSessionExpiry(t *testing.T) {
+	tests := []struct {
+		Comment string
+		Props   []byte
+		Seconds uint32
+		Present bool
+	}{
+		{"absent", nil, 0, false},
+		{"one hour", []byte{0x11, 0x00, 0x00, 0x0e, 0x10}, 3600, true},
+		{"never expires", []byte{0x11, 0xff, 0xff, 0xff, 0xff}, 0xffffffff, true},
+	}
+
+	for _, test := range tests {
+		body := []byte{0x00, 0x04, 'M', 'Q', 'T', 'T', 0x05, 0x02, 0x00, 0x0a}
+		body = append(body, byte(len(test.Props)))
+		body = append(body, test.Props...)
+		body = append(body, 0x00, 0x03, 'c', 'i', 'd')
+		encoded := append([]byte{0x10, byte(len(body))}, body...)
+
+		msg, err := DecodeOneMessage(bytes.NewBuffer(encoded), nil)
+		if err != nil {
+			t.Errorf("%s: Unexpected error during decoding: %v", test.Comment, err)
+			continue
+		}
+		if seconds, present := msg.(*Connect).SessionExpiry(); seconds != test.Seconds || present != test.Present {
+			t.Errorf("%s: SessionExpiry returned %d, %t, expected %d, %t",
+				test.Comment, seconds, present, test.Seconds, test.Present)
+		}
+
+		encodedBuf := new(bytes.Buffer)
+		if err := msg.Encode(encodedBuf); err != nil {
+			t.Errorf("%s: Unexpected error during encoding: %v", test.Comment, err)
+		} else if !bytes.Equal(encoded, encodedBuf.Bytes()) {
+			t.Errorf("%s: Encoded bytes mismatch\n     got = %#v\nexpected = %#v",
+				test.Comment, encodedBuf.Bytes(), encoded)
+		}
+	}
+
+	msg := &Connect{ProtocolName: "MQTT", ProtocolVersion: 4, SessionExpiryInterval: new(uint32)}
+	if err := msg.Encode(new(bytes.Buffer)); err != ErrUnsupportedVersion {
+		t.Errorf("MQTT 3.1.1: Expected error %v, got %v", ErrUnsupportedVersion, err)
+	}
+}
+
+func TestDisconnectClearsWill(t *testing.T) {
+	tests := []struct {
+		Comment string
+		Msg     *Disconnect
+		Encoded []byte
+		Clears  bool
+	}{
+		{"MQTT 3.1.1 DISCONNECT", &Disconnect{}, []byte{0xe0, 0x00}, true},
+		{"MQTT 5.0 normal disconnection", &Disconnect{ProtocolVersion: 5}, []byte{0xe0, 0x00}, true},
+		{"MQTT 5.0 Disconnect with Will Message", &Disconnect{ProtocolVersion: 5, ReasonCode: 0x04}, []byte{0xe0, 0x01, 0x04}, false},
+		{"MQTT 5.0 Session taken over", &Disconnect{ProtocolVersion: 5, ReasonCode: 0x8e}, []byte{0xe0, 0x01, 0x8e}, false},
+	}
+
+	for _, test := range tests {
+		if clears := test.Msg.ClearsWill(); clears != test.Clears {
+			t.Errorf("%s: ClearsWill returned %t, expected %t", test.Comment, clears, test.Clears)
+		}
+		encodedBuf := new(bytes.Buffer)
+		if err := test.Msg.Encode(encodedBuf); err != nil {
+			t.Errorf("%s: Unexpected error during encoding: %v", test.Comment, err)
+		} else if !bytes.Equal(test.Encoded, encodedBuf.Bytes()) {
+			t.Errorf("%s: Encoded bytes mismatch\n     got = %#v\nexpected = %#v", test.Comment, encodedBuf.Bytes(), test.Encoded)
+		}
+		if n, err := test.Msg.EncodedLen(); err != nil {
+			t.Errorf("%s: Unexpected error from EncodedLen: %v", test.Comment, err)
+		} else if n != len(test.Encoded) {
+			t.Errorf("%s: EncodedLen returned %d, expected %d", test.Comment, n, len(test.Encoded))
+		}
+
+		config := DecodeOptions{ProtocolVersion: test.Msg.ProtocolVersion}
+		if msg, err := DecodeOneMessage(bytes.NewBuffer(test.Encoded), config); err != nil {
+			t.Errorf("%s: Unexpected error during decoding: %v", test.Comment, err)
+		} else if clears := msg.(*Disconnect).ClearsWill(); clears != test.Clears {
+			t.Errorf("%s: Decoded message ClearsWill returned %t, expected %t", test.Comment, clears, test.Clears)
+		}
+	}
+
+	// Before MQTT 5.0, DISCONNECT has no body.
+	if err := (&Disconnect{ReasonCode: 0x04}).Encode(new(bytes.Buffer)); err != ErrUnsupportedVersion {
+		t.Errorf("Expected error %v encoding MQTT 3.1 DISCONNECT with a reason code, got %v", ErrUnsupportedVersion, err)
+	}
+	if _, err := (&Disconnect{ReasonCode: 0x04}).EncodedLen(); err != ErrUnsupportedVersion {
+		t.Errorf("Expected error %v from EncodedLen of MQTT 3.1 DISCONNECT with a reason code, got %v", ErrUnsupportedVersion, err)
+	}
+}
+
+func TestDecodeErrorOffset(t *testing.T) {
+	tests := []struct {
+		Comment string
+		Bytes   []byte
+		Err     error
+		Offset  int
+	}{
+		{
+			Comment: "SUBSCRIBE topic longer than packet",
+			Bytes: []byte{
+				0x82, 0x08,
+				0x43, 0x21, // MessageId
+				0x00, 0x07, 'a', '/', 'b', // Topic
+				0x01, // Topic QoS
+			},
+			Err:    ErrDataExceedsPacket,
+			Offset: 6,
+		},
+		{
+			Comment: "SUBSCRIBE truncated within topic",
+			Bytes: []byte{
+				0x82, 0x08,
+				0x43, 0x21, // MessageId
+				0x00, 0x03, 'a', // Topic
+			},
+			Err:    io.ErrUnexpectedEOF,
+			Offset: 6,
+		},
+		{
+			Comment: "PINGREQ with trailing bytes",
+			Bytes:   []byte{0xc0, 0x01, 0x00},
+			Err:     ErrTrailingBytes,
+			Offset:  2,
+		},
+	}
+
+	for _, test := range tests {
+		_, err := DecodeOneMessage(bytes.NewBuffer(test.Bytes), nil)
+		var decodeErr *DecodeError
+		if !errors.As(err, &decodeErr) {
+			t.Errorf("%s: Expected *DecodeError, got %#v", test.Comment, err)
+			continue
+		}
+		if !errors.Is(err, test.Err) {
+			t.Errorf("%s: Expected error %v, got %v", test.Comment, test.Err, err)
+		}
+		if decodeErr.Offset() != test.Offset {
+			t.Errorf("%s: Expected offset %d, got %d (%v)", test.Comment, test.Offset, decodeErr.Offset(), err)
+		}
+	}
+}
+
+func TestHeaderDecodeLeavesBody(t *testing.T) {
+	encodedBuf := new(bytes.Buffer)
+	publish := &Publish{Header: Header{Retain: true}, TopicName: "a/b", Payload: BytesPayload{1, 2, 3}}
+	publish.Encode(encodedBuf)
+	encoded := append([]byte{}, encodedBuf.Bytes()...)
+
+	var hdr Header
+	msgType, remainingLength, err := hdr.Decode(encodedBuf)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if msgType != MsgPublish || remainingLength != 8 || hdr != publish.Header {
+		t.Errorf("Decode() = %v, %d, header %#v, expected %v, 8, header %#v", msgType, remainingLength, hdr, MsgPublish, publish.Header)
+	}
+	if body := encodedBuf.Bytes(); !bytes.Equal(encoded[2:], body) {
+		t.Errorf("Body mismatch after decoding header\n     got = %#v\nexpected = %#v", body, encoded[2:])
+	}
+}
+
+func TestDecodeFrame(t *testing.T) {
+	pubAck := []byte{0x40, 0x02, 0x12, 0x34}
+	if msg, err := DecodeFrame(pubAck, nil); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	} else if expected := NewPubAck(0x1234); !reflect.DeepEqual(expected, msg) {
+		t.Errorf("Decoded value mismatch\n     got = %#v\nexpected = %#v", msg, expected)
+	}
+
+	tests := []struct {
+		Comment string
+		Frame   []byte
+		Err     error
+	}{
+		{"trailing bytes", []byte{0x40, 0x02, 0x12, 0x34, 0xc0, 0x00}, ErrTrailingBytes},
+		{"truncated", []byte{0x40, 0x02, 0x12}, ErrIncompletePacket},
+		{"empty", []byte{}, ErrIncompletePacket},
+		{"bad length", []byte{0x40, 0xff, 0xff, 0xff, 0xff}, ErrBadLengthEncoding},
+	}
+	for _, test := range tests {
+		if _, err := DecodeFrame(test.Frame, nil); !errors.Is(err, test.Err) {
+			t.Errorf("%s: Expected error %v, got %v", test.Comment, test.Err, err)
+		}
+	}
+}
+
+func TestPacketScanner(t *testing.T) {
+	publish := &Publish{TopicName: "a/b", Payload: BytesPayload(make([]byte, 200))}
+	encodedBuf := new(bytes.Buffer)
+	publish.Encode(encodedBuf)
+	(&PingReq{}).Encode(encodedBuf)
+	encoded := encodedBuf.Bytes()
+
+	// Split the PUBLISH within its two byte remaining length and its body, and
+	// feed the end of it together with the PINGREQ.
+	var s PacketScanner
+	var msgs []Message
+	for _, piece := range [][]byte{encoded[:2], encoded[2:3], encoded[3:100], encoded[100:]} {
+		for len(piece) > 0 {
+			complete, consumed := s.Feed(piece)
+			piece = piece[consumed:]
+			if !complete {
+				if len(piece) != 0 {
+					t.Fatalf("Feed consumed %d bytes of an incomplete message, leaving %d", consumed, len(piece))
+				}
+				if _, err := s.Packet(); !errors.Is(err, ErrIncompletePacket) {
+					t.Errorf("Expected error %v for incomplete message, got %v", ErrIncompletePacket, err)
+				}
+				break
+			}
+			msg, err := s.Packet()
+			if err != nil {
+				t.Fatalf("Unexpected error decoding message %d: %v", len(msgs), err)
+			}
+			msgs = append(msgs, msg)
+		}
+	}
+
+	if expected := []Message{publish, &PingReq{}}; !reflect.DeepEqual(expected, msgs) {
+		t.Errorf("Decoded messages mismatch\n     got = %#v\nexpected = %#v", msgs, expected)
+	}
+
+	if complete, consumed := s.Feed([]byte{0x30, 0xff, 0xff, 0xff, 0xff, 0x00}); !complete || consumed != 5 {
+		t.Errorf("Feed with bad length = %t, %d, expected true, 5", complete, consumed)
+	}
+	if _, err := s.Packet(); !errors.Is(err, ErrBadLengthEncoding) {
+		t.Errorf("Expected error %v, got %v", ErrBadLengthEncoding, err)
+	}
+
+	// The body of a message that is too large is not buffered.
+	s.Config = DecodeOptions{MaxRemainingLength: 100}
+	if complete, consumed := s.Feed(encoded); !complete || consumed != 3 {
+		t.Errorf("Feed with oversized message = %t, %d, expected true, 3", complete, consumed)
+	}
+	if _, err := s.Packet(); !errors.Is(err, ErrPacketTooLarge) {
+		t.Errorf("Expected error %v, got %v", ErrPacketTooLarge, err)
+	}
+	if complete, consumed := s.Feed([]byte{0xc0, 0x00}); !complete || consumed != 2 {
+		t.Errorf("Feed after oversized message = %t, %d, expected true, 2", complete, consumed)
+	}
+	if msg, err := s.Packet(); err != nil || !reflect.DeepEqual(msg, &PingReq{}) {
+		t.Errorf("Expected PINGREQ after oversized message, got %#v, %v", msg, err)
+	}
+}
+
+func TestDecodeOneMessageRaw(t *testing.T) {
+	encoded := []byte{0x32, 0x08, 0x00, 0x01, 'a', 0x12, 0x34, 0x01, 0x02, 0x03}
+	next := []byte{0xc0, 0x00}
+	r := bytes.NewReader(append(encoded[:len(encoded):len(encoded)], next...))
+
+	msg, raw, err := DecodeOneMessageRaw(r, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !bytes.Equal(encoded, raw) {
+		t.Errorf("Raw bytes mismatch\n     got = %#v\nexpected = %#v", raw, encoded)
+	}
+	if r.Len() != len(next) {
+		t.Errorf("Expected %d bytes to remain unread, got %d", len(next), r.Len())
+	}
+
+	redecoded, err := DecodeOneMessage(bytes.NewReader(raw), nil)
+	if err != nil {
+		t.Fatalf("Unexpected error re-decoding raw bytes: %v", err)
+	}
+	if !reflect.DeepEqual(msg, redecoded) {
+		t.Errorf("Re-decoded value mismatch\n     got = %#v\nexpected = %#v", redecoded, msg)
+	}
+}
+
+func TestDecodePublishInto(t *testing.T) {
+	encoded := []byte{0x30, 0x06, 0x00, 0x01, 'a', 0x01, 0x02, 0x03}
+
+	dst := make([]byte, 3)
+	msg, n, err := DecodePublishInto(bytes.NewBuffer(encoded), dst)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := &Publish{TopicName: "a", Payload: BytesPayload{1, 2, 3}}
+	if n != 3 || !reflect.DeepEqual(expected, msg) {
+		t.Errorf("Decoded value mismatch\n     got = %#v, %d\nexpected = %#v, 3", msg, n, expected)
+	}
+	if !bytes.Equal(dst, []byte{1, 2, 3}) {
+		t.Errorf("Payload not decoded into dst: %#v", dst)
+	}
+
+	if _, _, err := DecodePublishInto(bytes.NewBuffer(encoded), make([]byte, 2)); !errors.Is(err, ErrBufferTooSmall) {
+		t.Errorf("Expected error %v, got %v", ErrBufferTooSmall, err)
+	}
+
+	msg, n, err = DecodePublishInto(bytes.NewBuffer([]byte{0x40, 0x02, 0x12, 0x34}), nil)
+	if err != nil || n != 0 || !reflect.DeepEqual(&PubAck{MessageId: 0x1234}, msg) {
+		t.Errorf("Unexpected result decoding PUBACK: %#v, %d, %v", msg, n, err)
+	}
+}
+
+func TestDecodeInto(t *testing.T) {
+	tests := []struct {
+		Comment string
+		// Prev is decoded into the reused message before Msg.
+		Prev, Msg Message
+	}{
+		{
+			Comment: "PUBLISH with QoS = QosAtMostOnce after QosAtLeastOnce",
+			Prev: &Publish{
+				Header:    Header{QosLevel: QosAtLeastOnce},
+				TopicName: "a/b/c",
+				MessageId: 0x1234,
+				Payload:   BytesPayload{1, 2, 3, 4},
+			},
+			Msg: &Publish{
+				TopicName: "a/b",
+				Payload:   BytesPayload{1, 2, 3},
+			},
+		},
+		{
+			Comment: "SUBSCRIBE with fewer topics",
+			Prev: &Subscribe{
+				Header:    Header{QosLevel: QosAtLeastOnce},
+				MessageId: 0x4321,
+				Topics:    []TopicQos{{"a/b", QosAtLeastOnce}, {"c/d", QosExactlyOnce}},
+			},
+			Msg: &Subscribe{
+				Header:    Header{QosLevel: QosAtLeastOnce},
+				MessageId: 0x1234,
+				Topics:    []TopicQos{{"e/f", QosAtMostOnce}},
+			},
+		},
+		{
+			Comment: "UNSUBSCRIBE with fewer topics",
+			Prev: &Unsubscribe{
+				Header:    Header{QosLevel: QosAtLeastOnce},
+				MessageId: 0x4321,
+				Topics:    []string{"a/b", "c/d"},
+			},
+			Msg: &Unsubscribe{
+				Header:    Header{QosLevel: QosAtLeastOnce},
+				MessageId: 0x1234,
+				Topics:    []string{"e/f"},
+			},
+		},
+		{
+			Comment: "SUBACK with fewer topics",
+			Prev:    &SubAck{MessageId: 0x1234, TopicsQos: []QosLevel{QosAtMostOnce, QosExactlyOnce}},
+			Msg:     &SubAck{MessageId: 0x4321, TopicsQos: []QosLevel{QosAtLeastOnce}},
+		},
+	}
+
+	for _, test := range tests {
+		encodedBuf := new(bytes.Buffer)
+		for _, msg := range []Message{test.Prev, test.Msg} {
+			if err := msg.Encode(encodedBuf); err != nil {
+				t.Fatalf("%s: Unexpected error during encoding: %v", test.Comment, err)
+			}
+		}
+		encoded := encodedBuf.Bytes()
+
+		expectedBuf := bytes.NewBuffer(encoded)
+		DecodeOneMessage(expectedBuf, nil)
+		expectedMsg, err := DecodeOneMessage(expectedBuf, nil)
+		if err != nil {
+			t.Fatalf("%s: Unexpected error during decoding: %v", test.Comment, err)
+		}
+
+		reusedBuf := bytes.NewBuffer(encoded)
+		reused, _ := NewMessage(messageTypeOf(test.Msg))
+		for i := 0; i < 2; i++ {
+			if err := DecodeInto(reusedBuf, reused, nil); err != nil {
+				t.Errorf("%s: Unexpected error during DecodeInto: %v", test.Comment, err)
+			}
+		}
+		if !reflect.DeepEqual(expectedMsg, reused) {
+			t.Errorf("%s: Decoded value mismatch\n     got = %#v\nexpected = %#v",
+				test.Comment, reused, expectedMsg)
+		}
+	}
+}
+
+func TestDecodeIntoAcksWithoutAllocating(t *testing.T) {
+	tests := []struct {
+		Msg      Message
+		Encoded  []byte
+		Expected Message
+	}{
+		{new(PubAck), []byte{0x40, 0x02, 0x12, 0x34}, &PubAck{MessageId: 0x1234}},
+		{new(PubRec), []byte{0x50, 0x02, 0x12, 0x34}, &PubRec{MessageId: 0x1234}},
+		{new(PubRel), []byte{0x62, 0x02, 0x12, 0x34}, &PubRel{Header: Header{QosLevel: QosAtLeastOnce}, MessageId: 0x1234}},
+		{new(PubComp), []byte{0x70, 0x02, 0x12, 0x34}, &PubComp{MessageId: 0x1234}},
+		{new(UnsubAck), []byte{0xb0, 0x02, 0x12, 0x34}, &UnsubAck{MessageId: 0x1234}},
+	}
+
+	for _, test := range tests {
+		r := bytes.NewReader(test.Encoded)
+		var err error
+		allocs := testing.AllocsPerRun(100, func() {
+			r.Reset(test.Encoded)
+			err = DecodeInto(r, test.Msg, nil)
+		})
+		if err != nil {
+			t.Errorf("%T: Unexpected error: %v", test.Msg, err)
+		} else if !reflect.DeepEqual(test.Expected, test.Msg) {
+			t.Errorf("%T: Decoded value mismatch\n     got = %#v\nexpected = %#v", test.Msg, test.Msg, test.Expected)
+		}
+		if allocs != 0 {
+			t.Errorf("%T: Expected no allocations, got %v", test.Msg, allocs)
+		}
+	}
+}
+
+func TestDecodeConnect(t *testing.T) {
+	expected := &Connect{
+		ProtocolName:    "MQTT",
+		ProtocolVersion: 4,
+		CleanSession:    true,
+		KeepAliveTimer:  30,
+		ClientId:        "client",
+		UsernameFlag:    true,
+		Username:        "user",
+	}
+	encodedBuf := new(bytes.Buffer)
+	expected.Encode(encodedBuf)
+	NewPubAck(0x1234).Encode(encodedBuf)
+
+	msg, err := DecodeConnect(encodedBuf, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(expected, msg) {
+		t.Errorf("Decoded value mismatch\n     got = %#v\nexpected = %#v", msg, expected)
+	}
+	if username, password, ok := msg.Credentials(); !ok || username != "user" || password != nil {
+		t.Errorf("Credentials() = %q, %#v, %t, expected %q, nil, true", username, password, ok, "user")
+	}
+	if _, ok := msg.Will(); ok {
+		t.Errorf("Will() ok = true, expected false")
+	}
+
+	if _, err := DecodeConnect(encodedBuf, nil); !errors.Is(err, ErrUnexpectedMsgType) {
+		t.Errorf("Expected error %v for PUBACK, got %v", ErrUnexpectedMsgType, err)
+	}
+}
+
+func TestDecodeIntoUnexpectedType(t *testing.T) {
+	buf := bytes.NewBuffer([]byte{
+		0x40, 0x02, 0x12, 0x34, // PUBACK.
+		0x50, 0x02, 0x43, 0x21, // PUBREC.
+	})
+
+	if err := DecodeInto(buf, new(PubRec), nil); !errors.Is(err, ErrUnexpectedMsgType) {
+		t.Errorf("Expected error %v, got %v", ErrUnexpectedMsgType, err)
+	}
+
+	msg := new(PubRec)
+	if err := DecodeInto(buf, msg, nil); err != nil {
+		t.Errorf("Unexpected error decoding following message: %v", err)
+	} else if msg.MessageId != 0x4321 {
+		t.Errorf("Expected MessageId 0x4321, got %#x", msg.MessageId)
+	}
+}
+
+var benchmarkSubscribe = &Subscribe{
+	Header:    Header{QosLevel: QosAtLeastOnce},
+	MessageId: 0x4321,
+	Topics:    []TopicQos{{"a/b", QosAtLeastOnce}, {"c/d", QosExactlyOnce}},
+}
+
+func BenchmarkDecodeOneMessage(b *testing.B) {
+	encodedBuf := new(bytes.Buffer)
+	benchmarkSubscribe.Encode(encodedBuf)
+	encoded := encodedBuf.Bytes()
+	r := bytes.NewReader(encoded)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		r.Reset(encoded)
+		if _, err := DecodeOneMessage(r, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodeInto(b *testing.B) {
+	encodedBuf := new(bytes.Buffer)
+	benchmarkSubscribe.Encode(encodedBuf)
+	encoded := encodedBuf.Bytes()
+	r := bytes.NewReader(encoded)
+	msg := new(Subscribe)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		r.Reset(encoded)
+		if err := DecodeInto(r, msg, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodeIntoPubAck(b *testing.B) {
+	encoded := []byte{0x40, 0x02, 0x12, 0x34}
+	r := bytes.NewReader(encoded)
+	msg := new(PubAck)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		r.Reset(encoded)
+		if err := DecodeInto(r, msg, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// benchmarkMixed is a mix of the messages of a typical connection, with
+// PUBLISH messages of various sizes.
+var benchmarkMixed = []Message{
+	&Connect{
+		ProtocolName:    "MQTT",
+		ProtocolVersion: 4,
+		CleanSession:    true,
+		KeepAliveTimer:  60,
+		ClientId:        "benchmark-client",
+		UsernameFlag:    true,
+		Username:        "user",
+		PasswordFlag:    true,
+		Password:        "password",
+	},
+	benchmarkSubscribe,
+	&Publish{TopicName: "sensors/1/temperature", Payload: BytesPayload(make([]byte, 16))},
+	&Publish{
+		Header:    Header{QosLevel: QosAtLeastOnce},
+		TopicName: "sensors/1/image",
+		MessageId: 0x1234,
+		Payload:   BytesPayload(make([]byte, 4096)),
+	},
+	NewPubAck(0x1234),
+	&Publish{
+		Header:    Header{QosLevel: QosExactlyOnce},
+		TopicName: "sensors/1/status",
+		MessageId: 0x1235,
+		Payload:   BytesPayload(make([]byte, 256)),
+	},
+	NewPubRec(0x1235),
+	NewPubRel(0x1235),
+	NewPubComp(0x1235),
+	&PingReq{},
+}
+
+func BenchmarkDecodeMixed(b *testing.B) {
+	encodedBuf := new(bytes.Buffer)
+	msgs := make([]Message, len(benchmarkMixed))
+	for i, msg := range benchmarkMixed {
+		if err := msg.Encode(encodedBuf); err != nil {
+			b.Fatal(err)
+		}
+		msgs[i], _ = NewMessage(messageTypeOf(msg))
+	}
+	encoded := encodedBuf.Bytes()
+	r := bytes.NewReader(encoded)
+
+	b.SetBytes(int64(len(encoded)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		r.Reset(encoded)
+		for _, msg := range msgs {
+			if err := DecodeInto(r, msg, nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkEncodeMixed(b *testing.B) {
+	encodedBuf := new(bytes.Buffer)
+	for _, msg := range benchmarkMixed {
+		msg.Encode(encodedBuf)
+	}
+
+	b.SetBytes(int64(encodedBuf.Len()))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		encodedBuf.Reset()
+		for _, msg := range benchmarkMixed {
+			if err := msg.Encode(encodedBuf); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkEncodeLargePublish(b *testing.B) {
+	msg := &Publish{
+		Header:    Header{QosLevel: QosAtLeastOnce},
+		TopicName: "a/b",
+		MessageId: 0x1234,
+		Payload:   BytesPayload(make([]byte, 1<<20)),
+	}
+
+	b.SetBytes(1 << 20)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := msg.Encode(io.Discard); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// readCounter counts the calls to Read on a reader.
+type readCounter struct {
+	r     *bytes.Reader
+	reads int
+}
+
+func (rc *readCounter) Read(p []byte) (int, error) {
+	rc.reads++
+	return rc.r.Read(p)
+}
+
+// byteReadCounter is a readCounter that also implements io.ByteReader. Calls
+// to ReadByte are not counted.
+type byteReadCounter struct {
+	readCounter
+}
+
+func (rc *byteReadCounter) ReadByte() (byte, error) {
+	return rc.r.ReadByte()
+}
+
+// BenchmarkDecodeReadCalls reports the number of Read calls made when decoding
+// from a reader with and without io.ByteReader.
+func BenchmarkDecodeReadCalls(b *testing.B) {
+	encodedBuf := new(bytes.Buffer)
+	benchmarkSubscribe.Encode(encodedBuf)
+	encoded := encodedBuf.Bytes()
+
+	run := func(b *testing.B, r io.Reader, rc *readCounter) {
+		for i := 0; i < b.N; i++ {
+			rc.r.Reset(encoded)
+			if _, err := DecodeOneMessage(r, nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ReportMetric(float64(rc.reads)/float64(b.N), "reads/op")
+	}
+
+	b.Run("Reader", func(b *testing.B) {
+		rc := &readCounter{r: bytes.NewReader(nil)}
+		run(b, rc, rc)
+	})
+	b.Run("ByteReader", func(b *testing.B) {
+		rc := &byteReadCounter{readCounter{r: bytes.NewReader(nil)}}
+		run(b, rc, &rc.readCounter)
+	})
+}
+
+func TestLengthEncodeDecode(t *testing.T) {
+	tests := []struct {
+		Value   int32
+		Encoded gbt.Matcher
+	}{
+		{0, gbt.Literal{0}},
+		{1, gbt.Literal{1}},
+		{20, gbt.Literal{20}},
+
+		// Boundary conditions used as tests taken from MQTT 3.1 spec.
+		{0, gbt.Literal{0x00}},
+		{127, gbt.Literal{0x7F}},
+		{128, gbt.Literal{0x80, 0x01}},
+		{16383, gbt.Literal{0xFF, 0x7F}},
+		{16384, gbt.Literal{0x80, 0x80, 0x01}},
+		{2097151, gbt.Literal{0xFF, 0xFF, 0x7F}},
+		{2097152, gbt.Literal{0x80, 0x80, 0x80, 0x01}},
+		{268435455, gbt.Literal{0xFF, 0xFF, 0xFF, 0x7F}},
+	}
+
+	for _, test := range tests {
+		{
+			// Test decoding.
+			buf := new(bytes.Buffer)
+			test.Encoded.Write(buf)
+			buf = bytes.NewBuffer(buf.Bytes())
+			if result := decodeLength(buf); test.Value != result {
 				t.Errorf("Decoding test %#x: got %#x", test.Value, result)
 			}
 		}
-		{
-			// Test encoding.
-			buf := new(bytes.Buffer)
-			encodeLength(test.Value, buf)
-			if err := gbt.Matches(test.Encoded, buf.Bytes()); err != nil {
-				t.Errorf("Encoding test %#x: %v", test.Value, err)
-			}
+		{
+			// Test encoded size.
+			buf := new(bytes.Buffer)
+			test.Encoded.Write(buf)
+			if result := encodedLengthSize(test.Value); result != buf.Len() {
+				t.Errorf("Size test %#x: got %d, expected %d", test.Value, result, buf.Len())
+			}
+		}
+		{
+			// Test encoding.
+			buf := new(bytes.Buffer)
+			encodeLength(test.Value, buf)
+			if err := gbt.Matches(test.Encoded, buf.Bytes()); err != nil {
+				t.Errorf("Encoding test %#x: %v", test.Value, err)
+			}
+		}
+	}
+}
+
+type SeqBytePayload struct {
+	N int
+	T *testing.T
+}
+
+func (p *SeqBytePayload) Size() int {
+	return p.N
+}
+
+func (p *SeqBytePayload) WritePayload(w io.Writer) error {
+	buf := make([]byte, 256)
+	for i := range buf {
+		buf[i] = byte(i)
+	}
+
+	for toWrite := p.N; toWrite > 0; toWrite -= 256 {
+		writeThisTime := toWrite
+		if writeThisTime > 256 {
+			writeThisTime = 256
+		}
+		if _, err := w.Write(buf[:writeThisTime]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *SeqBytePayload) ReadPayload(r io.Reader) error {
+	buf := make([]byte, 256)
+
+	for toRead := p.N; toRead > 0; toRead -= 256 {
+		readThisTime := toRead
+		if readThisTime > 256 {
+			readThisTime = 256
+		}
+		if _, err := io.ReadFull(r, buf[:readThisTime]); err != nil {
+			p.T.Errorf("Got unexpected error %v", err)
+			return err
+		}
+		for i, v := range buf[:readThisTime] {
+			if v != byte(i) {
+				p.T.Errorf("Got unexpected byte %#x, expected %#x", v, i)
+				return io.ErrClosedPipe
+			}
+		}
+	}
+
+	// Any more reads should produce an EOF.
+	if n, err := r.Read(buf); n > 0 {
+		p.T.Errorf("Got unexpected extra %d bytes of data", n)
+	} else if err != io.EOF {
+		p.T.Errorf("Expected err=EOF, got %v", err)
+	}
+
+	return nil
+}
+
+// Stream a reasonably large Publish payload containing sequential byte values.
+func TestPipedPublish(t *testing.T) {
+	r, w := io.Pipe()
+
+	complete := make(chan bool)
+
+	payload := &SeqBytePayload{
+		N: 20 + (1 << 20),
+		T: t,
+	}
+
+	go func() {
+		defer func() {
+			complete <- true
+			w.Close()
+		}()
+
+		msg := &Publish{
+			TopicName: "foo",
+			Payload:   payload,
+		}
+		if err := msg.Encode(w); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	go func() {
+		defer func() {
+			complete <- true
+			r.Close()
+		}()
+
+		expectedMsg := &Publish{
+			TopicName: "foo",
+			Payload:   payload,
+		}
+
+		testConfig := &ValueConfig{payload}
+
+		if msg, err := DecodeOneMessage(r, testConfig); err != nil {
+			t.Error(err)
+		} else if !reflect.DeepEqual(expectedMsg, msg) {
+			t.Errorf("     got = %#v\nexpected = %#v", msg, expectedMsg)
+		}
+	}()
+
+	_ = <-complete
+	_ = <-complete
+}
+
+func TestAutoRespond(t *testing.T) {
+	tests := []struct {
+		Comment  string
+		Msg      Message
+		Expected Message
+	}{
+		{"CONNECT", &Connect{ProtocolName: "MQIsdp", ProtocolVersion: 3}, &ConnAck{ReturnCode: RetCodeAccepted}},
+		{"CONNACK", &ConnAck{}, nil},
+		{"PUBLISH with QoS = QosAtMostOnce", &Publish{TopicName: "a/b"}, nil},
+		{
+			"PUBLISH with QoS = QosAtLeastOnce",
+			&Publish{Header: Header{QosLevel: QosAtLeastOnce}, TopicName: "a/b", MessageId: 0x1234},
+			&PubAck{MessageId: 0x1234},
+		},
+		{
+			"PUBLISH with QoS = QosExactlyOnce",
+			&Publish{Header: Header{QosLevel: QosExactlyOnce}, TopicName: "a/b", MessageId: 0x1234},
+			&PubRec{MessageId: 0x1234},
+		},
+		{"PUBACK", &PubAck{MessageId: 0x1234}, nil},
+		{"PUBREC", &PubRec{MessageId: 0x1234}, &PubRel{Header: Header{QosLevel: QosAtLeastOnce}, MessageId: 0x1234}},
+		{"PUBREL", &PubRel{MessageId: 0x1234}, &PubComp{MessageId: 0x1234}},
+		{"PUBCOMP", &PubComp{MessageId: 0x1234}, nil},
+		{
+			"SUBSCRIBE",
+			&Subscribe{
+				Header:    Header{QosLevel: QosAtLeastOnce},
+				MessageId: 0x4321,
+				Topics:    []TopicQos{{"a/b", QosAtLeastOnce}, {"c/d", QosExactlyOnce}},
+			},
+			&SubAck{MessageId: 0x4321, TopicsQos: []QosLevel{QosAtLeastOnce, QosExactlyOnce}},
+		},
+		{"SUBACK", &SubAck{MessageId: 0x4321}, nil},
+		{
+			"UNSUBSCRIBE",
+			&Unsubscribe{Header: Header{QosLevel: QosAtLeastOnce}, MessageId: 0x4321, Topics: []string{"a/b"}},
+			&UnsubAck{MessageId: 0x4321},
+		},
+		{"UNSUBACK", &UnsubAck{MessageId: 0x4321}, nil},
+		{"PINGREQ", &PingReq{}, &PingResp{}},
+		{"PINGRESP", &PingResp{}, nil},
+		{"DISCONNECT", &Disconnect{}, nil},
+	}
+
+	for _, test := range tests {
+		resp, ok := AutoRespond(test.Msg)
+		if ok != (test.Expected != nil) {
+			t.Errorf("%s: Expected ok=%t, got %t", test.Comment, test.Expected != nil, ok)
+		} else if ok && !reflect.DeepEqual(test.Expected, resp) {
+			t.Errorf("%s: Response mismatch\n     got = %#v\nexpected = %#v",
+				test.Comment, resp, test.Expected)
+		}
+	}
+}
+
+func TestShouldDeliverNoLocal(t *testing.T) {
+	tests := []struct {
+		Comment              string
+		Opts                 SubscriptionOptions
+		Publisher, Recipient string
+		Expected             bool
+	}{
+		{"No Local, own message", SubscriptionOptions{NoLocal: true}, "client", "client", false},
+		{"No Local, other client's message", SubscriptionOptions{NoLocal: true}, "other", "client", true},
+		{"without No Local, own message", SubscriptionOptions{}, "client", "client", true},
+		{"without No Local, other client's message", SubscriptionOptions{}, "other", "client", true},
+	}
+
+	for _, test := range tests {
+		if deliver := ShouldDeliverNoLocal(test.Opts, test.Publisher, test.Recipient); deliver != test.Expected {
+			t.Errorf("%s: Expected %t, got %t", test.Comment, test.Expected, deliver)
+		}
+	}
+}
+
+func TestSubscriptionOptionsValidateForFilter(t *testing.T) {
+	tests := []struct {
+		Comment  string
+		Opts     SubscriptionOptions
+		Filter   string
+		Expected error
+	}{
+		{"all options", SubscriptionOptions{NoLocal: true, RetainAsPublished: true, RetainHandling: RetainDoNotSend}, "a/+/#", nil},
+		{"shared subscription", SubscriptionOptions{RetainAsPublished: true, RetainHandling: RetainSendIfNew}, "$share/group/a/#", nil},
+		{"Retain Handling 3", SubscriptionOptions{RetainHandling: 3}, "a/b", ErrBadRetainHandling},
+		{"Retain Handling 3 on shared subscription", SubscriptionOptions{RetainHandling: 3}, "$share/group/a", ErrBadRetainHandling},
+		{"No Local on shared subscription", SubscriptionOptions{NoLocal: true}, "$share/group/a", ErrNoLocalOnShared},
+		{"shared subscription without ShareName", SubscriptionOptions{}, "$share//a", ErrBadSharedSubscription},
+		{"shared subscription with wildcard ShareName", SubscriptionOptions{}, "$share/gr+up/a", ErrBadSharedSubscription},
+		{"shared subscription without topic filter", SubscriptionOptions{}, "$share/group", ErrBadSharedSubscription},
+		{"shared subscription with empty topic filter", SubscriptionOptions{}, "$share/group/", ErrBadSharedSubscription},
+	}
+
+	for _, test := range tests {
+		if err := test.Opts.ValidateForFilter(test.Filter); err != test.Expected {
+			t.Errorf("%s: Expected error %v, got %v", test.Comment, test.Expected, err)
+		}
+	}
+}
+
+func TestExceedsMaxQoS(t *testing.T) {
+	mixed := &Subscribe{Topics: []TopicQos{{"a", QosAtMostOnce}, {"b", QosExactlyOnce}, {"c", QosAtLeastOnce}}}
+	tests := []struct {
+		Comment  string
+		Msg      Message
+		MaxQos   QosLevel
+		Expected bool
+	}{
+		{"PUBLISH QoS 2, max 1", &Publish{Header: Header{QosLevel: QosExactlyOnce}}, QosAtLeastOnce, true},
+		{"PUBLISH QoS 1, max 1", &Publish{Header: Header{QosLevel: QosAtLeastOnce}}, QosAtLeastOnce, false},
+		{"PUBLISH QoS 1, max 0", &Publish{Header: Header{QosLevel: QosAtLeastOnce}}, QosAtMostOnce, true},
+		{"SUBSCRIBE mixed QoS, max 1", mixed, QosAtLeastOnce, true},
+		{"SUBSCRIBE mixed QoS, max 2", mixed, QosExactlyOnce, false},
+		{"SUBSCRIBE no topics, max 0", &Subscribe{}, QosAtMostOnce, false},
+		{"PUBREL, max 0", &PubRel{Header: Header{QosLevel: QosAtLeastOnce}}, QosAtMostOnce, false},
+	}
+
+	for _, test := range tests {
+		if got := ExceedsMaxQoS(test.Msg, test.MaxQos); got != test.Expected {
+			t.Errorf("%s: Expected %t, got %t", test.Comment, test.Expected, got)
+		}
+	}
+}
+
+func TestKeepAliveExpired(t *testing.T) {
+	last := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		KeepAlive uint16
+		Elapsed   time.Duration
+		Expected  bool
+	}{
+		{10, 10 * time.Second, false},
+		{10, 15 * time.Second, false},
+		{10, 15*time.Second + time.Nanosecond, true},
+		{1, 1500 * time.Millisecond, false},
+		{1, 1501 * time.Millisecond, true},
+		{0, 0, false},
+		{0, 24 * time.Hour, false},
+	}
+
+	for _, test := range tests {
+		if got := KeepAliveExpired(test.KeepAlive, last, last.Add(test.Elapsed)); got != test.Expected {
+			t.Errorf("KeepAliveExpired(%d, +%v) = %t, expected %t", test.KeepAlive, test.Elapsed, got, test.Expected)
+		}
+	}
+}
+
+func TestConnectWill(t *testing.T) {
+	will := &Will{Topic: "status", Message: []byte("offline"), Qos: QosAtLeastOnce, Retain: true}
+
+	msg := &Connect{ProtocolName: "MQTT", ProtocolVersion: 4}
+	msg.SetWill(will)
+	expected := &Connect{
+		ProtocolName:    "MQTT",
+		ProtocolVersion: 4,
+		WillFlag:        true,
+		WillTopic:       "status",
+		WillMessage:     "offline",
+		WillQos:         QosAtLeastOnce,
+		WillRetain:      true,
+	}
+	if !reflect.DeepEqual(expected, msg) {
+		t.Errorf("SetWill mismatch\n     got = %#v\nexpected = %#v", msg, expected)
+	}
+	if got, ok := msg.Will(); !ok || !reflect.DeepEqual(will, got) {
+		t.Errorf("Will() = %#v, %t, expected %#v, true", got, ok, will)
+	}
+
+	msg.SetWill(nil)
+	if expected := (&Connect{ProtocolName: "MQTT", ProtocolVersion: 4}); !reflect.DeepEqual(expected, msg) {
+		t.Errorf("SetWill(nil) mismatch\n     got = %#v\nexpected = %#v", msg, expected)
+	}
+	if got, ok := msg.Will(); ok {
+		t.Errorf("Will() = %#v, true after SetWill(nil), expected false", got)
+	}
+
+	// SetWill(nil) also clears the MQTT 5.0 will properties.
+	msg = &Connect{ProtocolName: "MQTT", ProtocolVersion: 5, WillProperties: &Properties{}, WillDelayInterval: new(uint32)}
+	msg.SetWill(nil)
+	if expected := (&Connect{ProtocolName: "MQTT", ProtocolVersion: 5}); !reflect.DeepEqual(expected, msg) {
+		t.Errorf("SetWill(nil) mismatch\n     got = %#v\nexpected = %#v", msg, expected)
+	}
+}
+
+func TestValidTopicFilter(t *testing.T) {
+	tests := []struct {
+		Filter string
+		Valid  bool
+	}{
+		{"a/b", true},
+		{"#", true},
+		{"+", true},
+		{"a/#", true},
+		{"+/b/+", true},
+		{"/", true},
+		{"a//b", true},
+		{"", false},
+		{"a/#/b", false},
+		{"a#", false},
+		{"a/+b", false},
+		{"a/b+", false},
+	}
+
+	for _, test := range tests {
+		if got := ValidTopicFilter(test.Filter); got != test.Valid {
+			t.Errorf("ValidTopicFilter(%q) = %t, expected %t", test.Filter, got, test.Valid)
+		}
+	}
+}
+
+func TestValidTopicName(t *testing.T) {
+	tests := []struct {
+		Name  string
+		Valid bool
+	}{
+		{"a/b", true},
+		{"/", true},
+		{"", false},
+		{"a/#", false},
+		{"a/+/b", false},
+	}
+
+	for _, test := range tests {
+		if got := ValidTopicName(test.Name); got != test.Valid {
+			t.Errorf("ValidTopicName(%q) = %t, expected %t", test.Name, got, test.Valid)
+		}
+	}
+}
+
+func TestConnectProtocolVersionName(t *testing.T) {
+	tests := []struct {
+		Version  uint8
+		Expected string
+	}{
+		{3, "MQIsdp/3.1"},
+		{4, "MQTT/3.1.1"},
+		{5, "MQTT/5.0"},
+		{0, ""},
+		{6, ""},
+	}
+
+	for _, test := range tests {
+		msg := &Connect{ProtocolVersion: test.Version}
+		if got := msg.ProtocolVersionName(); got != test.Expected {
+			t.Errorf("ProtocolVersionName() for version %d = %q, expected %q", test.Version, got, test.Expected)
+		}
+	}
+}
+
+func TestValidMessageId(t *testing.T) {
+	tests := []struct {
+		Comment  string
+		Msg      Message
+		Expected bool
+	}{
+		{"PUBLISH with QoS = QosAtMostOnce and no MessageId", &Publish{TopicName: "a/b"}, true},
+		{"PUBLISH with QoS = QosAtLeastOnce and MessageId 0", &Publish{Header: Header{QosLevel: QosAtLeastOnce}}, false},
+		{"PUBLISH with QoS = QosAtLeastOnce and MessageId 1", &Publish{Header: Header{QosLevel: QosAtLeastOnce}, MessageId: 1}, true},
+		{"PUBACK with MessageId 0", &PubAck{}, false},
+		{"PUBACK with MessageId 1", &PubAck{MessageId: 1}, true},
+		{"PUBREC with MessageId 0", &PubRec{}, false},
+		{"PUBREL with MessageId 0", &PubRel{}, false},
+		{"PUBCOMP with MessageId 0", &PubComp{}, false},
+		{"SUBSCRIBE with MessageId 0", &Subscribe{}, false},
+		{"SUBACK with MessageId 0", &SubAck{}, false},
+		{"UNSUBSCRIBE with MessageId 0", &Unsubscribe{}, false},
+		{"UNSUBACK with MessageId 0", &UnsubAck{}, false},
+		{"UNSUBACK with MessageId 1", &UnsubAck{MessageId: 1}, true},
+		{"CONNECT", &Connect{}, true},
+		{"PINGREQ", &PingReq{}, true},
+	}
+
+	for _, test := range tests {
+		if got := ValidMessageId(test.Msg); got != test.Expected {
+			t.Errorf("%s: Expected %t, got %t", test.Comment, test.Expected, got)
+		}
+	}
+}
+
+func TestPublishWithRetain(t *testing.T) {
+	stored := &Publish{Header: Header{Retain: true}, TopicName: "a/b", Payload: BytesPayload{1, 2, 3}}
+
+	live := stored.WithRetain(false)
+	if live.Header.Retain {
+		t.Errorf("WithRetain(false) returned a message with Retain set")
+	}
+	if !stored.Header.Retain {
+		t.Errorf("WithRetain(false) cleared Retain on the original message")
+	}
+	expected := &Publish{TopicName: "a/b", Payload: BytesPayload{1, 2, 3}}
+	if !reflect.DeepEqual(expected, live) {
+		t.Errorf("WithRetain(false) mismatch\n     got = %#v\nexpected = %#v", live, expected)
+	}
+
+	if retained := live.WithRetain(true); !retained.Header.Retain || live.Header.Retain {
+		t.Errorf("WithRetain(true) = Retain %t, original Retain %t, expected true, false", retained.Header.Retain, live.Header.Retain)
+	}
+}
+
+func TestWithMessageId(t *testing.T) {
+	msg := &PubAck{Header: Header{DupFlag: true}, MessageId: 0x1234}
+	remapped, err := WithMessageId(msg, 0x4321)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := &PubAck{Header: Header{DupFlag: true}, MessageId: 0x4321}
+	if !reflect.DeepEqual(expected, remapped) {
+		t.Errorf("Remapped value mismatch\n     got = %#v\nexpected = %#v", remapped, expected)
+	}
+	if msg.MessageId != 0x1234 {
+		t.Errorf("Original message modified: %#v", msg)
+	}
+
+	publish := &Publish{Header: Header{QosLevel: QosAtLeastOnce}, TopicName: "a/b", MessageId: 1, Payload: BytesPayload{1}}
+	if remapped, err := WithMessageId(publish, 2); err != nil || remapped.(*Publish).MessageId != 2 || remapped.(*Publish).TopicName != "a/b" {
+		t.Errorf("Unexpected result remapping PUBLISH: %#v, %v", remapped, err)
+	}
+
+	for _, msg := range []Message{&Publish{TopicName: "a/b"}, &Connect{}, &PingReq{}} {
+		if _, err := WithMessageId(msg, 1); !errors.Is(err, ErrNoMessageId) {
+			t.Errorf("%T: Expected error %v, got %v", msg, ErrNoMessageId, err)
+		}
+	}
+}
+
+func TestSubscriptionDiff(t *testing.T) {
+	tests := []struct {
+		Comment    string
+		Prev, Next []TopicQos
+		Added      []string
+		Removed    []string
+		ChangedQos []string
+	}{
+		{
+			Comment: "unchanged",
+			Prev:    []TopicQos{{"a", QosAtMostOnce}, {"b", QosAtLeastOnce}},
+			Next:    []TopicQos{{"b", QosAtLeastOnce}, {"a", QosAtMostOnce}},
+		},
+		{
+			Comment: "additions",
+			Prev:    []TopicQos{{"a", QosAtMostOnce}},
+			Next:    []TopicQos{{"c", QosAtMostOnce}, {"a", QosAtMostOnce}, {"b", QosExactlyOnce}},
+			Added:   []string{"c", "b"},
+		},
+		{
+			Comment: "removals",
+			Prev:    []TopicQos{{"a", QosAtMostOnce}, {"b", QosAtLeastOnce}, {"c", QosAtMostOnce}},
+			Next:    []TopicQos{{"b", QosAtLeastOnce}},
+			Removed: []string{"a", "c"},
+		},
+		{
+			Comment:    "QoS changes",
+			Prev:       []TopicQos{{"a", QosAtMostOnce}, {"b", QosAtLeastOnce}},
+			Next:       []TopicQos{{"a", QosExactlyOnce}, {"b", QosAtLeastOnce}},
+			ChangedQos: []string{"a"},
+		},
+		{
+			Comment:    "all, with duplicates",
+			Prev:       []TopicQos{{"a", QosAtMostOnce}, {"b", QosAtLeastOnce}, {"a", QosAtLeastOnce}},
+			Next:       []TopicQos{{"c", QosAtMostOnce}, {"c", QosAtLeastOnce}, {"a", QosExactlyOnce}},
+			Added:      []string{"c"},
+			Removed:    []string{"b"},
+			ChangedQos: []string{"a"},
+		},
+	}
+
+	for _, test := range tests {
+		added, removed, changedQos := SubscriptionDiff(&Subscribe{Topics: test.Prev}, &Subscribe{Topics: test.Next})
+		if !reflect.DeepEqual(test.Added, added) || !reflect.DeepEqual(test.Removed, removed) || !reflect.DeepEqual(test.ChangedQos, changedQos) {
+			t.Errorf("%s: Expected (%q, %q, %q), got (%q, %q, %q)", test.Comment,
+				test.Added, test.Removed, test.ChangedQos, added, removed, changedQos)
+		}
+	}
+}
+
+func TestValidateHandshake(t *testing.T) {
+	connect := &Connect{ProtocolName: "MQIsdp", ProtocolVersion: 3}
+	publish := &Publish{TopicName: "a/b"}
+
+	tests := []struct {
+		Comment string
+		Msgs    []Message
+		Valid   bool
+	}{
+		{"accepted", []Message{connect, &ConnAck{}}, true},
+		{"accepted then traffic", []Message{connect, &ConnAck{}, publish, &PingReq{}, &PingResp{}, &Disconnect{}}, true},
+		{"refused", []Message{connect, &ConnAck{ReturnCode: RetCodeNotAuthorized}}, true},
+		{"no messages", nil, false},
+		{"no CONNECT", []Message{&ConnAck{}, publish}, false},
+		{"no CONNACK", []Message{connect}, false},
+		{"PUBLISH before CONNACK", []Message{connect, publish, &ConnAck{}}, false},
+		{"invalid return code", []Message{connect, &ConnAck{ReturnCode: 6}}, false},
+		{"traffic after refusal", []Message{connect, &ConnAck{ReturnCode: RetCodeNotAuthorized}, publish}, false},
+		{"second CONNECT", []Message{connect, &ConnAck{}, publish, connect}, false},
+	}
+
+	for _, test := range tests {
+		err := ValidateHandshake(test.Msgs)
+		if test.Valid && err != nil {
+			t.Errorf("%s: Unexpected error: %v", test.Comment, err)
+		} else if !test.Valid && !errors.Is(err, ErrBadHandshake) {
+			t.Errorf("%s: Expected error %v, got %v", test.Comment, ErrBadHandshake, err)
+		}
+	}
+}
+
+func TestSubscribeSubAckWithAuth(t *testing.T) {
+	msg := &Subscribe{
+		Header:    Header{QosLevel: QosAtLeastOnce},
+		MessageId: 0x4321,
+		Topics:    []TopicQos{{"public/a", QosExactlyOnce}, {"private/b", QosAtLeastOnce}, {"public/c", QosAtLeastOnce}},
+	}
+	subAck := msg.SubAckWithAuth(func(filter string) (QosLevel, bool) {
+		if strings.HasPrefix(filter, "private/") {
+			return 0, false
+		}
+		// Grant at most QoS 1.
+		return QosAtLeastOnce, true
+	})
+
+	expected := &SubAck{MessageId: 0x4321, TopicsQos: []QosLevel{QosAtLeastOnce, SubAckFailure, QosAtLeastOnce}}
+	if !reflect.DeepEqual(expected, subAck) {
+		t.Errorf("SUBACK mismatch\n     got = %#v\nexpected = %#v", subAck, expected)
+	}
+}
+
+func TestNewAcks(t *testing.T) {
+	tests := []struct {
+		Comment  string
+		Msg      Message
+		Expected []byte
+	}{
+		{"PUBACK", NewPubAck(0x1234), []byte{0x40, 0x02, 0x12, 0x34}},
+		{"PUBREC", NewPubRec(0x1234), []byte{0x50, 0x02, 0x12, 0x34}},
+		{"PUBREL", NewPubRel(0x1234), []byte{0x62, 0x02, 0x12, 0x34}},
+		{"PUBCOMP", NewPubComp(0x1234), []byte{0x70, 0x02, 0x12, 0x34}},
+		{"UNSUBACK", NewUnsubAck(5), []byte{0xb0, 0x02, 0x00, 0x05}},
+	}
+
+	for _, test := range tests {
+		encodedBuf := new(bytes.Buffer)
+		if err := test.Msg.Encode(encodedBuf); err != nil {
+			t.Errorf("%s: Unexpected error during encoding: %v", test.Comment, err)
+		} else if !bytes.Equal(test.Expected, encodedBuf.Bytes()) {
+			t.Errorf("%s: Encoded bytes mismatch\n     got = %#v\nexpected = %#v", test.Comment, encodedBuf.Bytes(), test.Expected)
+		}
+
+		if decoded, err := DecodeOneMessage(encodedBuf, nil); err != nil {
+			t.Errorf("%s: Unexpected error during decoding: %v", test.Comment, err)
+		} else if !reflect.DeepEqual(test.Msg, decoded) {
+			t.Errorf("%s: Decoded value mismatch\n     got = %#v\nexpected = %#v", test.Comment, decoded, test.Msg)
+		}
+	}
+
+	if err := NewUnsubAck(0).Encode(new(bytes.Buffer)); !errors.Is(err, ErrMissingMessageId) {
+		t.Errorf("UNSUBACK with MessageId 0: Expected error %v, got %v", ErrMissingMessageId, err)
+	}
+}
+
+func TestNewSubAck(t *testing.T) {
+	granted := []QosLevel{QosAtMostOnce, QosExactlyOnce, SubAckFailure}
+	msg, err := NewSubAck(0x4321, granted)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	encodedBuf := new(bytes.Buffer)
+	if err := msg.Encode(encodedBuf); err != nil {
+		t.Fatalf("Unexpected error during encoding: %v", err)
+	}
+	expectedBytes := []byte{0x90, 0x05, 0x43, 0x21, 0x00, 0x02, 0x80}
+	if !bytes.Equal(expectedBytes, encodedBuf.Bytes()) {
+		t.Errorf("Encoded bytes mismatch\n     got = %#v\nexpected = %#v", encodedBuf.Bytes(), expectedBytes)
+	}
+
+	decoded, err := DecodeOneMessage(encodedBuf, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error during decoding: %v", err)
+	}
+	if !reflect.DeepEqual(msg, decoded) {
+		t.Errorf("Decoded value mismatch\n     got = %#v\nexpected = %#v", decoded, msg)
+	}
+
+	if _, err := NewSubAck(0x4321, []QosLevel{QosAtLeastOnce, 3}); !errors.Is(err, ErrBadQos) {
+		t.Errorf("Expected error %v for invalid granted QoS, got %v", ErrBadQos, err)
+	}
+}
+
+func TestExpectsResponse(t *testing.T) {
+	tests := []struct {
+		Comment  string
+		Msg      Message
+		Expected MessageType
+	}{
+		{"CONNECT", &Connect{}, MsgConnAck},
+		{"CONNACK", &ConnAck{}, 0},
+		{"PUBLISH with QoS = QosAtMostOnce", &Publish{}, 0},
+		{"PUBLISH with QoS = QosAtLeastOnce", &Publish{Header: Header{QosLevel: QosAtLeastOnce}}, MsgPubAck},
+		{"PUBLISH with QoS = QosExactlyOnce", &Publish{Header: Header{QosLevel: QosExactlyOnce}}, MsgPubRec},
+		{"PUBACK", &PubAck{}, 0},
+		{"PUBREC", &PubRec{}, MsgPubRel},
+		{"PUBREL", &PubRel{}, MsgPubComp},
+		{"PUBCOMP", &PubComp{}, 0},
+		{"SUBSCRIBE", &Subscribe{}, MsgSubAck},
+		{"SUBACK", &SubAck{}, 0},
+		{"UNSUBSCRIBE", &Unsubscribe{}, MsgUnsubAck},
+		{"UNSUBACK", &UnsubAck{}, 0},
+		{"PINGREQ", &PingReq{}, MsgPingResp},
+		{"PINGRESP", &PingResp{}, 0},
+		{"DISCONNECT", &Disconnect{}, 0},
+	}
+
+	for _, test := range tests {
+		respType, ok := ExpectsResponse(test.Msg)
+		if ok != (test.Expected != 0) || respType != test.Expected {
+			t.Errorf("%s: Expected (%d, %t), got (%d, %t)", test.Comment, test.Expected, test.Expected != 0, respType, ok)
+		}
+	}
+}
+
+func TestRetransmittable(t *testing.T) {
+	tests := []struct {
+		Comment  string
+		Msg      Message
+		Expected bool
+	}{
+		{"CONNECT", &Connect{ProtocolName: "MQIsdp", ProtocolVersion: 3}, false},
+		{"CONNACK", &ConnAck{}, false},
+		{"PUBLISH with QoS = QosAtMostOnce", &Publish{TopicName: "a/b"}, false},
+		{"PUBLISH with QoS = QosAtLeastOnce", &Publish{Header: Header{QosLevel: QosAtLeastOnce}, TopicName: "a/b"}, true},
+		{"PUBLISH with QoS = QosExactlyOnce", &Publish{Header: Header{QosLevel: QosExactlyOnce}, TopicName: "a/b"}, true},
+		{"PUBACK", &PubAck{}, false},
+		{"PUBREC", &PubRec{}, true},
+		{"PUBREL", &PubRel{}, true},
+		{"PUBCOMP", &PubComp{}, false},
+		{"SUBSCRIBE", &Subscribe{}, false},
+		{"SUBACK", &SubAck{}, false},
+		{"UNSUBSCRIBE", &Unsubscribe{}, false},
+		{"UNSUBACK", &UnsubAck{}, false},
+		{"PINGREQ", &PingReq{}, false},
+		{"PINGRESP", &PingResp{}, false},
+		{"DISCONNECT", &Disconnect{}, false},
+	}
+
+	for _, test := range tests {
+		if got := Retransmittable(test.Msg); got != test.Expected {
+			t.Errorf("%s: Expected %t, got %t", test.Comment, test.Expected, got)
+		}
+	}
+}
+
+func TestDecodeStrictFixedHeaderFlags(t *testing.T) {
+	// SUBSCRIBE with the RETAIN bit set.
+	encoded := []byte{
+		0x83, 0x08,
+		0x43, 0x21, // MessageId
+		0x00, 0x03, 'a', '/', 'b', // Topic
+		0x01, // Topic QoS
+	}
+	expected := &Subscribe{
+		Header:    Header{QosLevel: QosAtLeastOnce, Retain: true},
+		MessageId: 0x4321,
+		Topics:    []TopicQos{{"a/b", QosAtLeastOnce}},
+	}
+
+	if msg, err := DecodeOneMessageOptions(bytes.NewBuffer(encoded), DecodeOptions{}); err != nil {
+		t.Errorf("Lenient: Unexpected error during decoding: %v", err)
+	} else if !reflect.DeepEqual(expected, msg) {
+		t.Errorf("Lenient: Decoded value mismatch\n     got = %#v\nexpected = %#v", msg, expected)
+	}
+
+	if _, err := DecodeOneMessageOptions(bytes.NewBuffer(encoded), DecodeOptions{Strict: true}); !errors.Is(err, ErrInvalidFixedHeaderFlags) {
+		t.Errorf("Strict: Expected error %v, got %v", ErrInvalidFixedHeaderFlags, err)
+	}
+
+	// MQTT 3.1 allows DUP on SUBSCRIBE, but it is rejected in strict mode.
+	encoded[0] = 0x8a
+	if _, err := DecodeOneMessageOptions(bytes.NewBuffer(encoded), DecodeOptions{Strict: true}); !errors.Is(err, ErrInvalidFixedHeaderFlags) {
+		t.Errorf("Strict with DUP: Expected error %v, got %v", ErrInvalidFixedHeaderFlags, err)
+	}
+}
+
+func TestDecodeStrictConnectReservedFlag(t *testing.T) {
+	encoded := []byte{
+		0x10, 0x11,
+		0x00, 0x06, 'M', 'Q', 'I', 's', 'd', 'p', // Protocol name
+		0x03,       // Protocol version
+		0x03,       // Flags: clean session and reserved bit
+		0x00, 0x1e, // Keep alive timer
+		0x00, 0x03, 'c', 'i', 'd', // Client ID
+	}
+	expected := &Connect{
+		ProtocolName:    "MQIsdp",
+		ProtocolVersion: 3,
+		CleanSession:    true,
+		KeepAliveTimer:  30,
+		ClientId:        "cid",
+	}
+
+	if msg, err := DecodeOneMessageOptions(bytes.NewBuffer(encoded), DecodeOptions{}); err != nil {
+		t.Errorf("Lenient: Unexpected error during decoding: %v", err)
+	} else if !reflect.DeepEqual(expected, msg) {
+		t.Errorf("Lenient: Decoded value mismatch\n     got = %#v\nexpected = %#v", msg, expected)
+	}
+
+	if _, err := DecodeOneMessageOptions(bytes.NewBuffer(encoded), DecodeOptions{Strict: true}); !errors.Is(err, ErrReservedFlagSet) {
+		t.Errorf("Strict: Expected error %v, got %v", ErrReservedFlagSet, err)
+	}
+}
+
+func TestDecodeConnectWillQosWithoutWill(t *testing.T) {
+	encoded := []byte{
+		0x10, 0x11,
+		0x00, 0x06, 'M', 'Q', 'I', 's', 'd', 'p', // Protocol name
+		0x03,       // Protocol version
+		0x12,       // Flags: clean session and will QoS 2, without will
+		0x00, 0x1e, // Keep alive timer
+		0x00, 0x03, 'c', 'i', 'd', // Client ID
+	}
+	expected := &Connect{
+		ProtocolName:    "MQIsdp",
+		ProtocolVersion: 3,
+		CleanSession:    true,
+		KeepAliveTimer:  30,
+		ClientId:        "cid",
+	}
+
+	if msg, err := DecodeOneMessage(bytes.NewBuffer(encoded), nil); err != nil {
+		t.Errorf("Unexpected error during decoding: %v", err)
+	} else if !reflect.DeepEqual(expected, msg) {
+		t.Errorf("Decoded value mismatch\n     got = %#v\nexpected = %#v", msg, expected)
+	}
+}
+
+func TestDisconnectReasonCode(t *testing.T) {
+	v5 := DecodeOptions{ProtocolVersion: 5}
+	tests := []struct {
+		Comment  string
+		Encoded  []byte
+		Expected *Disconnect
+	}{
+		{"no reason code", []byte{0xe0, 0x00}, &Disconnect{ProtocolVersion: 5}},
+		{"normal disconnection", []byte{0xe0, 0x01, 0x00}, &Disconnect{ProtocolVersion: 5}},
+		{"server shutting down", []byte{0xe0, 0x01, 0x8b}, &Disconnect{ProtocolVersion: 5, ReasonCode: ReasonServerShuttingDown}},
+		{"with reason string", []byte{0xe0, 0x07, 0x8b, 0x05, 0x1f, 0x00, 0x02, 'b', 'y'}, &Disconnect{ProtocolVersion: 5, ReasonCode: ReasonServerShuttingDown, ReasonString: "by"}},
+		{
+			"with skipped properties",
+			[]byte{0xe0, 0x07, 0x8b, 0x05, 0x11, 0x00, 0x00, 0x00, 0x3c},
+			&Disconnect{ProtocolVersion: 5, ReasonCode: ReasonServerShuttingDown},
+		},
+	}
+
+	for _, test := range tests {
+		if msg, err := DecodeOneMessage(bytes.NewBuffer(test.Encoded), v5); err != nil {
+			t.Errorf("%s: Unexpected error during decoding: %v", test.Comment, err)
+		} else if !reflect.DeepEqual(test.Expected, msg) {
+			t.Errorf("%s: Decoded value mismatch\n     got = %#v\nexpected = %#v", test.Comment, msg, test.Expected)
+		}
+	}
+
+	encodedBuf := new(bytes.Buffer)
+	if err := (&Disconnect{ProtocolVersion: 5, ReasonCode: ReasonServerShuttingDown}).Encode(encodedBuf); err != nil {
+		t.Errorf("Unexpected error during encoding: %v", err)
+	} else if expected := []byte{0xe0, 0x01, 0x8b}; !bytes.Equal(expected, encodedBuf.Bytes()) {
+		t.Errorf("Encoded bytes mismatch\n     got = %#v\nexpected = %#v", encodedBuf.Bytes(), expected)
+	}
+
+	// Before MQTT 5.0, DISCONNECT has no body.
+	if _, err := DecodeOneMessage(bytes.NewBuffer([]byte{0xe0, 0x01, 0x8b}), nil); !errors.Is(err, ErrTrailingBytes) {
+		t.Errorf("Expected error %v for MQTT 3.1 DISCONNECT with a body, got %v", ErrTrailingBytes, err)
+	}
+	msg := &Disconnect{ReasonCode: 0x8b}
+	if err := msg.Encode(new(bytes.Buffer)); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("Expected error %v encoding MQTT 3.1 DISCONNECT with a reason code, got %v", ErrUnsupportedVersion, err)
+	}
+	if _, err := msg.EncodedLen(); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("Expected error %v from EncodedLen for MQTT 3.1 DISCONNECT with a reason code, got %v", ErrUnsupportedVersion, err)
+	}
+}
+
+func TestAckReasonCode(t *testing.T) {
+	v5 := DecodeOptions{ProtocolVersion: 5}
+	props := []byte{
+		0x1f, 0x00, 0x02, 'n', 'o', // Reason String
+		0x26, 0x00, 0x01, 'k', 0x00, 0x01, 'v', // User Property
+	}
+	bodies := []struct {
+		Comment  string
+		Body     []byte
+		Expected AckReason
+	}{
+		{"message ID only", []byte{0x12, 0x34}, AckReason{ProtocolVersion: 5}},
+		{"reason code", []byte{0x12, 0x34, 0x10}, AckReason{ProtocolVersion: 5, ReasonCode: 0x10}},
+		{"reason code and properties", append([]byte{0x12, 0x34, 0x92, byte(len(props))}, props...), AckReason{
+			ProtocolVersion: 5,
+			ReasonCode:      0x92,
+			ReasonString:    "no",
+			UserProperties:  []UserProperty{{Key: "k", Value: "v"}},
+		}},
+	}
+	types := []struct {
+		Name   string
+		Header byte
+		New    func(reason AckReason) Message
+	}{
+		{"PUBACK", 0x40, func(reason AckReason) Message { return &PubAck{MessageId: 0x1234, AckReason: reason} }},
+		{"PUBREC", 0x50, func(reason AckReason) Message { return &PubRec{MessageId: 0x1234, AckReason: reason} }},
+		{"PUBREL", 0x62, func(reason AckReason) Message {
+			return &PubRel{Header: Header{QosLevel: QosAtLeastOnce}, MessageId: 0x1234, AckReason: reason}
+		}},
+		{"PUBCOMP", 0x70, func(reason AckReason) Message { return &PubComp{MessageId: 0x1234, AckReason: reason} }},
+	}
+
+	for _, typ := range types {
+		for _, body := range bodies {
+			encoded := append([]byte{typ.Header, byte(len(body.Body))}, body.Body...)
+			expected := typ.New(body.Expected)
+			comment := typ.Name + " with " + body.Comment
+
+			msg, err := DecodeOneMessage(bytes.NewBuffer(encoded), v5)
+			if err != nil {
+				t.Errorf("%s: Unexpected error during decoding: %v", comment, err)
+				continue
+			}
+			if !reflect.DeepEqual(expected, msg) {
+				t.Errorf("%s: Decoded value mismatch\n     got = %#v\nexpected = %#v", comment, msg, expected)
+			}
+
+			encodedBuf := new(bytes.Buffer)
+			if err := msg.Encode(encodedBuf); err != nil {
+				t.Errorf("%s: Unexpected error during encoding: %v", comment, err)
+			} else if !bytes.Equal(encoded, encodedBuf.Bytes()) {
+				t.Errorf("%s: Encoded bytes mismatch\n     got = %#v\nexpected = %#v", comment, encodedBuf.Bytes(), encoded)
+			}
+			if n, err := msg.(Sizer).EncodedLen(); err != nil || n != len(encoded) {
+				t.Errorf("%s: Expected EncodedLen %d, got %d, %v", comment, len(encoded), n, err)
+			}
+		}
+	}
+
+	repeated := []byte{0x40, 0x0c, 0x12, 0x34, 0x80, 0x08, 0x1f, 0x00, 0x01, 'a', 0x1f, 0x00, 0x01, 'b'}
+	if _, err := DecodeOneMessage(bytes.NewBuffer(repeated), v5); !errors.Is(err, ErrBadProperty) {
+		t.Errorf("Expected error %v for a repeated Reason String, got %v", ErrBadProperty, err)
+	}
+
+	// Before MQTT 5.0, the acknowledgements only contain the message ID.
+	if _, err := DecodeOneMessage(bytes.NewBuffer([]byte{0x40, 0x03, 0x12, 0x34, 0x10}), nil); !errors.Is(err, ErrTrailingBytes) {
+		t.Errorf("Expected error %v for MQTT 3.1 PUBACK with a reason code, got %v", ErrTrailingBytes, err)
+	}
+	msg := &PubAck{MessageId: 0x1234, AckReason: AckReason{ReasonString: "no"}}
+	if err := msg.Encode(new(bytes.Buffer)); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("Expected error %v encoding MQTT 3.1 PUBACK with a reason string, got %v", ErrUnsupportedVersion, err)
+	}
+	if _, err := msg.EncodedLen(); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("Expected error %v from EncodedLen for MQTT 3.1 PUBACK with a reason string, got %v", ErrUnsupportedVersion, err)
+	}
+}
+
+func TestDecodeUnsupportedVersion(t *testing.T) {
+	v5 := DecodeOptions{ProtocolVersion: 5}
+	encoded := []byte{
+		0xb0, 0x02, 0x12, 0x34, // UNSUBACK
+		0xc0, 0x00, // PINGREQ
+	}
+
+	r := bytes.NewBuffer(encoded)
+	if _, err := DecodeOneMessage(r, v5); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("Expected error %v decoding MQTT 5.0 UNSUBACK, got %v", ErrUnsupportedVersion, err)
+	}
+	// The unsupported message is skipped.
+	if msg, err := DecodeOneMessage(r, v5); err != nil || !reflect.DeepEqual(msg, &PingReq{}) {
+		t.Errorf("Expected PINGREQ after unsupported message, got %#v, %v", msg, err)
+	}
+}
+
+func TestDecodeConnAckReasonCode(t *testing.T) {
+	v5 := DecodeOptions{ProtocolVersion: 5}
+
+	// 0x87 (Not Authorized), followed by an empty property block.
+	expected := &ConnAck{ReturnCode: ReturnCode(ReasonNotAuthorized)}
+	if msg, err := DecodeOneMessage(bytes.NewBuffer([]byte{0x20, 0x03, 0x00, 0x87, 0x00}), v5); err != nil {
+		t.Errorf("Unexpected error decoding v5 CONNACK: %v", err)
+	} else if !reflect.DeepEqual(expected, msg) {
+		t.Errorf("Decoded value mismatch\n     got = %#v\nexpected = %#v", msg, expected)
+	}
+
+	if _, err := DecodeOneMessage(bytes.NewBuffer([]byte{0x20, 0x03, 0x00, 0x40, 0x00}), v5); !errors.Is(err, ErrBadReturnCode) {
+		t.Errorf("Expected error %v for v5 CONNACK reason code 0x40, got %v", ErrBadReturnCode, err)
+	}
+
+	// 0x87 is not a valid MQTT 3.1.1 return code.
+	if _, err := DecodeOneMessage(bytes.NewBuffer([]byte{0x20, 0x02, 0x00, 0x87}), nil); !errors.Is(err, ErrBadReturnCode) {
+		t.Errorf("Expected error %v for v3 CONNACK return code 0x87, got %v", ErrBadReturnCode, err)
+	}
+}
+
+func TestPublishProperties(t *testing.T) {
+	v5 := DecodeOptions{ProtocolVersion: 5}
+	encoded := []byte{
+		0x30, 0x12,
+		0x00, 0x03, 'a', '/', 'b', // Topic name.
+		0x0a,             // Property length.
+		0x23, 0x00, 0x05, // Topic Alias.
+		0x26, 0x00, 0x01, 'k', 0x00, 0x01, 'v', // User Property.
+		0x01, 0x02, // Payload.
+	}
+	alias := uint16(5)
+	expected := &Publish{
+		TopicName: "a/b",
+		Properties: &Properties{
+			TopicAlias:     &alias,
+			UserProperties: []UserProperty{{Key: "k", Value: "v"}},
+		},
+		Payload: BytesPayload{1, 2},
+	}
+
+	if msg, err := DecodeOneMessage(bytes.NewBuffer(encoded), v5); err != nil {
+		t.Errorf("Unexpected error during decoding: %v", err)
+	} else if !reflect.DeepEqual(expected, msg) {
+		t.Errorf("Decoded value mismatch\n     got = %#v\nexpected = %#v", msg, expected)
+	}
+
+	encodedBuf := new(bytes.Buffer)
+	if err := expected.Encode(encodedBuf); err != nil {
+		t.Errorf("Unexpected error during encoding: %v", err)
+	} else if !bytes.Equal(encoded, encodedBuf.Bytes()) {
+		t.Errorf("Encoded bytes mismatch\n     got = %#v\nexpected = %#v", encodedBuf.Bytes(), encoded)
+	}
+
+	// A v5 PUBLISH with no properties still has a property length.
+	expected = &Publish{TopicName: "a/b", Properties: &Properties{}, Payload: BytesPayload{}}
+	if msg, err := DecodeOneMessage(bytes.NewBuffer([]byte{0x30, 0x06, 0x00, 0x03, 'a', '/', 'b', 0x00}), v5); err != nil {
+		t.Errorf("Unexpected error during decoding: %v", err)
+	} else if !reflect.DeepEqual(expected, msg) {
+		t.Errorf("Decoded value mismatch\n     got = %#v\nexpected = %#v", msg, expected)
+	}
+
+	errTests := []struct {
+		Comment string
+		Encoded []byte
+		Err     error
+	}{
+		{"unknown property", []byte{0x30, 0x08, 0x00, 0x03, 'a', '/', 'b', 0x02, 0x7f, 0x00}, ErrBadProperty},
+		{"repeated Topic Alias", []byte{0x30, 0x0c, 0x00, 0x03, 'a', '/', 'b', 0x06, 0x23, 0x00, 0x01, 0x23, 0x00, 0x02}, ErrBadProperty},
+		{"property length exceeds packet", []byte{0x30, 0x06, 0x00, 0x03, 'a', '/', 'b', 0x05}, ErrDataExceedsPacket},
+		{"property exceeds property length", []byte{0x30, 0x09, 0x00, 0x03, 'a', '/', 'b', 0x01, 0x23, 0x00, 0x05}, ErrDataExceedsPacket},
+	}
+	for _, test := range errTests {
+		if _, err := DecodeOneMessage(bytes.NewBuffer(test.Encoded), v5); !errors.Is(err, test.Err) {
+			t.Errorf("%s: Expected error %v, got %v", test.Comment, test.Err, err)
+		}
+	}
+}
+
+func TestDisconnectForError(t *testing.T) {
+	tests := []struct {
+		Err      error
+		Expected ReasonCode
+	}{
+		{ErrBadLengthEncoding, ReasonMalformedPacket},
+		{&DecodeError{err: ErrTrailingBytes, offset: 4}, ReasonMalformedPacket},
+		{ErrTruncatedPublish, ReasonMalformedPacket},
+		{ErrUnexpectedMsgType, ReasonProtocolError},
+		{ErrPacketTooLarge, ReasonPacketTooLarge},
+		{ErrPacketTimeout, ReasonKeepAliveTimeout},
+		{ErrTooManyTopics, ReasonQuotaExceeded},
+		{ErrInvalidTopicFilter, ReasonTopicFilterInvalid},
+		{ErrInvalidTopicName, ReasonTopicNameInvalid},
+		{ErrWildcardInTopicName, ReasonTopicNameInvalid},
+		{ErrInternal, ReasonImplementationError},
+		{errors.New("other"), ReasonUnspecifiedError},
+	}
+
+	for _, test := range tests {
+		msg := DisconnectForError(test.Err)
+		if msg.ReasonCode != test.Expected {
+			t.Errorf("%v: Expected reason code %#x, got %#x", test.Err, test.Expected, msg.ReasonCode)
+		}
+		if msg.ReasonString != test.Err.Error() {
+			t.Errorf("%v: Expected reason string %q, got %q", test.Err, test.Err.Error(), msg.ReasonString)
+		}
+	}
+
+	if msg := DisconnectForError(nil); !reflect.DeepEqual(msg, &Disconnect{ProtocolVersion: 5}) {
+		t.Errorf("Expected a normal disconnection for a nil error, got %#v", msg)
+	}
+
+	// The DISCONNECT round trips with its reason string.
+	expected := DisconnectForError(ErrPacketTooLarge)
+	encodedBuf := new(bytes.Buffer)
+	if err := expected.Encode(encodedBuf); err != nil {
+		t.Fatalf("Unexpected error during encoding: %v", err)
+	}
+	if n, err := expected.EncodedLen(); err != nil || n != encodedBuf.Len() {
+		t.Errorf("EncodedLen() = %d, %v, expected %d", n, err, encodedBuf.Len())
+	}
+	if msg, err := DecodeOneMessage(encodedBuf, DecodeOptions{ProtocolVersion: 5}); err != nil {
+		t.Errorf("Unexpected error during decoding: %v", err)
+	} else if !reflect.DeepEqual(expected, msg) {
+		t.Errorf("Decoded value mismatch\n     got = %#v\nexpected = %#v", msg, expected)
+	}
+}
+
+func TestPublishUserProperties(t *testing.T) {
+	props := []UserProperty{{"k", "1"}, {"other", "x"}, {"k", "2"}}
+	msg := &Publish{TopicName: "a/b", Properties: &Properties{UserProperties: props}, Payload: BytesPayload{}}
+
+	encodedBuf := new(bytes.Buffer)
+	if err := msg.Encode(encodedBuf); err != nil {
+		t.Fatalf("Unexpected error during encoding: %v", err)
+	}
+	decoded, err := DecodeOneMessage(encodedBuf, DecodeOptions{ProtocolVersion: 5})
+	if err != nil {
+		t.Fatalf("Unexpected error during decoding: %v", err)
+	}
+	if got := decoded.(*Publish).UserProperties(); !reflect.DeepEqual(props, got) {
+		t.Errorf("UserProperties() = %v, expected %v", got, props)
+	}
+
+	if got := (&Publish{}).UserProperties(); got != nil {
+		t.Errorf("UserProperties() without properties = %v, expected nil", got)
+	}
+}
+
+func TestPublishContentType(t *testing.T) {
+	// PUBLISH with a Content Type of "application/json".
+	encoded := []byte{
+		0x30, 0x1b,
+		0x00, 0x03, 'a', '/', 'b',
+		0x13, 0x03, 0x00, 0x10, 'a', 'p', 'p', 'l', 'i', 'c', 'a', 't', 'i', 'o', 'n', '/', 'j', 's', 'o', 'n',
+		'{', '}',
+	}
+	msg, err := DecodeOneMessage(bytes.NewBuffer(encoded), DecodeOptions{ProtocolVersion: 5})
+	if err != nil {
+		t.Fatalf("Unexpected error during decoding: %v", err)
+	}
+	if contentType, ok := msg.(*Publish).ContentType(); !ok || contentType != "application/json" {
+		t.Errorf("ContentType() = %q, %t, expected %q, true", contentType, ok, "application/json")
+	}
+
+	// Without the property, and as MQTT 3.1.1.
+	for _, msg := range []*Publish{{Properties: &Properties{}}, {}} {
+		if contentType, ok := msg.ContentType(); ok {
+			t.Errorf("ContentType() = %q, true for %#v, expected false", contentType, msg)
+		}
+	}
+}
+
+func TestDecodeMaxTopics(t *testing.T) {
+	const numTopics = 5000
+
+	// Messages of numTopics empty topics.
+	subscribe := []byte{0x82, 0x9a, 0x75, 0x12, 0x34} // 2 + 3*5000 bytes.
+	subscribe = append(subscribe, bytes.Repeat([]byte{0x00, 0x00, 0x00}, numTopics)...)
+	unsubscribe := []byte{0xa2, 0x92, 0x4e, 0x12, 0x34} // 2 + 2*5000 bytes.
+	unsubscribe = append(unsubscribe, bytes.Repeat([]byte{0x00, 0x00}, numTopics)...)
+	subAck := []byte{0x90, 0x8a, 0x27, 0x12, 0x34} // 2 + 5000 bytes.
+	subAck = append(subAck, bytes.Repeat([]byte{0x00}, numTopics)...)
+
+	for _, encoded := range [][]byte{subscribe, unsubscribe, subAck} {
+		if _, err := DecodeOneMessage(bytes.NewBuffer(encoded), DecodeOptions{MaxTopics: 100}); !errors.Is(err, ErrTooManyTopics) {
+			t.Errorf("%#x: Expected error %v, got %v", encoded[0], ErrTooManyTopics, err)
+		}
+		if _, err := DecodeOneMessage(bytes.NewBuffer(encoded), DecodeOptions{MaxTopics: numTopics}); err != nil {
+			t.Errorf("%#x: Unexpected error with MaxTopics %d: %v", encoded[0], numTopics, err)
+		}
+	}
+}
+
+// panicPayload panics with a runtime error when read, as a bug in a Payload
+// implementation might.
+type panicPayload struct{}
+
+func (p panicPayload) Size() int                      { return 0 }
+func (p panicPayload) WritePayload(w io.Writer) error { return nil }
+func (p panicPayload) ReadPayload(r io.Reader) error {
+	var b []byte
+	_ = b[len(b)]
+	return nil
+}
+
+type panicDecoderConfig struct{}
+
+func (c panicDecoderConfig) MakePayload(msg *Publish, r io.Reader, n int) (Payload, error) {
+	return panicPayload{}, nil
+}
+
+// vendorMessage is a message of the reserved type 15, carrying arbitrary data.
+type vendorMessage struct {
+	Header
+	Data []byte
+}
+
+const msgVendor = MessageType(15)
+
+func (msg *vendorMessage) Encode(w io.Writer) error {
+	if err := msg.Header.Encode(w, msgVendor, int32(len(msg.Data))); err != nil {
+		return err
+	}
+	_, err := w.Write(msg.Data)
+	return err
+}
+
+func (msg *vendorMessage) Decode(r io.Reader, hdr Header, packetRemaining int32, config DecoderConfig) error {
+	msg.Header = hdr
+	msg.Data = make([]byte, packetRemaining)
+	_, err := io.ReadFull(r, msg.Data)
+	return err
+}
+
+func TestRegisterMessage(t *testing.T) {
+	encoded := []byte{0xf3, 0x02, 0x12, 0x34}
+	if _, err := DecodeOneMessage(bytes.NewBuffer(encoded), nil); !errors.Is(err, ErrBadMsgType) {
+		t.Errorf("Expected error %v before registering, got %v", ErrBadMsgType, err)
+	}
+
+	if err := RegisterMessage(msgVendor, func() Message { return new(vendorMessage) }); err != nil {
+		t.Fatalf("Unexpected error registering: %v", err)
+	}
+	defer RegisterMessage(msgVendor, nil)
+
+	expected := &vendorMessage{Header: Header{QosLevel: QosAtLeastOnce, Retain: true}, Data: []byte{0x12, 0x34}}
+	if msg, err := DecodeOneMessage(bytes.NewBuffer(encoded), DecodeOptions{Strict: true}); err != nil {
+		t.Errorf("Unexpected error decoding: %v", err)
+	} else if !reflect.DeepEqual(expected, msg) {
+		t.Errorf("Decoded value mismatch\n     got = %#v\nexpected = %#v", msg, expected)
+	}
+
+	encodedBuf := new(bytes.Buffer)
+	if err := expected.Encode(encodedBuf); err != nil {
+		t.Errorf("Unexpected error encoding: %v", err)
+	} else if !bytes.Equal(encoded, encodedBuf.Bytes()) {
+		t.Errorf("Encoded bytes mismatch\n     got = %#v\nexpected = %#v", encodedBuf.Bytes(), encoded)
+	}
+
+	// A registered type is decoded for any protocol version.
+	if msg, err := DecodeOneMessage(bytes.NewBuffer(encoded), DecodeOptions{ProtocolVersion: 5}); err != nil {
+		t.Errorf("Unexpected error decoding for MQTT 5.0: %v", err)
+	} else if !reflect.DeepEqual(expected, msg) {
+		t.Errorf("Decoded value mismatch\n     got = %#v\nexpected = %#v", msg, expected)
+	}
+
+	// The Decoder counts the message by its registered type.
+	d := NewDecoder(bytes.NewBuffer(encoded))
+	if _, err := d.Decode(); err != nil {
+		t.Errorf("Unexpected error from Decoder: %v", err)
+	} else if stats := d.Stats(); stats.ByType[msgVendor] != 1 || stats.ByType[0] != 0 {
+		t.Errorf("Unexpected Decoder stats: %+v", stats)
+	}
+
+	for _, msgType := range []MessageType{MsgPublish, MessageType(16)} {
+		if err := RegisterMessage(msgType, func() Message { return new(vendorMessage) }); !errors.Is(err, ErrBadMsgType) {
+			t.Errorf("Expected error %v registering type %d, got %v", ErrBadMsgType, msgType, err)
+		}
+	}
+}
+
+func TestDecodeRecoversPanic(t *testing.T) {
+	encoded := []byte{0x30, 0x06, 0x00, 0x03, 'a', '/', 'b', 0x01}
+	_, err := DecodeOneMessage(bytes.NewBuffer(encoded), panicDecoderConfig{})
+	if !errors.Is(err, ErrInternal) {
+		t.Fatalf("Expected error %v, got %v", ErrInternal, err)
+	}
+	if !strings.Contains(err.Error(), "index out of range") {
+		t.Errorf("Expected error to include the recovered value, got %q", err.Error())
+	}
+}
+
+func TestDecodeStrictWildcardInTopicName(t *testing.T) {
+	// PUBLISH to "a/#/b".
+	encoded := []byte{0x30, 0x07, 0x00, 0x05, 'a', '/', '#', '/', 'b'}
+	if _, err := DecodeOneMessage(bytes.NewBuffer(encoded), DecodeOptions{Strict: true}); !errors.Is(err, ErrWildcardInTopicName) || !errors.Is(err, ErrInvalidTopicName) {
+		t.Errorf("Expected error %v in strict mode, got %v", ErrWildcardInTopicName, err)
+	}
+	if _, err := DecodeOneMessage(bytes.NewBuffer(encoded), nil); err != nil {
+		t.Errorf("Unexpected error in non-strict mode: %v", err)
+	}
+
+	// PUBLISH with an empty topic name.
+	encoded = []byte{0x30, 0x02, 0x00, 0x00}
+	if _, err := DecodeOneMessage(bytes.NewBuffer(encoded), DecodeOptions{Strict: true}); !errors.Is(err, ErrInvalidTopicName) || errors.Is(err, ErrWildcardInTopicName) {
+		t.Errorf("Expected error %v in strict mode, got %v", ErrInvalidTopicName, err)
+	}
+
+	// MQTT 5.0 PUBLISH with an empty topic name and a Topic Alias.
+	encoded = []byte{0x30, 0x06, 0x00, 0x00, 0x03, 0x23, 0x00, 0x01}
+	if _, err := DecodeOneMessage(bytes.NewBuffer(encoded), DecodeOptions{Strict: true, ProtocolVersion: 5}); err != nil {
+		t.Errorf("Unexpected error in strict mode with a Topic Alias: %v", err)
+	}
+
+	// PUBLISH to "a/b/c".
+	encoded = []byte{0x30, 0x07, 0x00, 0x05, 'a', '/', 'b', '/', 'c'}
+	if _, err := DecodeOneMessage(bytes.NewBuffer(encoded), DecodeOptions{Strict: true}); err != nil {
+		t.Errorf("Unexpected error in strict mode: %v", err)
+	}
+	if err := (&Publish{TopicName: "a/b/c", Payload: BytesPayload{}}).Encode(io.Discard); err != nil {
+		t.Errorf("Unexpected error encoding: %v", err)
+	}
+}
+
+func TestDecodeTruncatedPublish(t *testing.T) {
+	// QoS 1 PUBLISH whose remaining length only covers the topic name.
+	encoded := []byte{0x32, 0x05, 0x00, 0x03, 'a', '/', 'b'}
+	_, err := DecodeOneMessage(bytes.NewBuffer(encoded), nil)
+	if !errors.Is(err, ErrTruncatedPublish) {
+		t.Errorf("Expected error %v, got %v", ErrTruncatedPublish, err)
+	}
+	var decodeErr *DecodeError
+	if !errors.As(err, &decodeErr) || decodeErr.Offset() != 7 {
+		t.Errorf("Expected *DecodeError at offset 7, got %#v", err)
+	}
+}
+
+func TestDecodeEmptyRetainedPublish(t *testing.T) {
+	msg, err := DecodeOneMessage(bytes.NewBuffer([]byte{0x31, 0x05, 0x00, 0x03, 'a', '/', 'b'}), nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	publish := msg.(*Publish)
+	if !publish.Header.Retain {
+		t.Errorf("Expected Retain to be set")
+	}
+	if payload, ok := publish.Payload.(BytesPayload); !ok || payload == nil || len(payload) != 0 {
+		t.Errorf("Expected empty non-nil BytesPayload, got %#v", publish.Payload)
+	}
+}
+
+func TestDecodeMaxRemainingLength(t *testing.T) {
+	// PUBLISH header declaring a 200MB remaining length, followed by only a
+	// topic name.
+	encoded := []byte{
+		0x30, 0x80, 0x80, 0xe8, 0x5f,
+		0x00, 0x03, 'a', '/', 'b', // Topic
+	}
+	opts := DecodeOptions{MaxRemainingLength: 1024}
+
+	if _, err := DecodeOneMessage(bytes.NewBuffer(encoded), opts); !errors.Is(err, ErrPacketTooLarge) {
+		t.Errorf("DecodeOneMessage: Expected error %v, got %v", ErrPacketTooLarge, err)
+	}
+	if err := DecodeInto(bytes.NewBuffer(encoded), &Publish{}, opts); !errors.Is(err, ErrPacketTooLarge) {
+		t.Errorf("DecodeInto: Expected error %v, got %v", ErrPacketTooLarge, err)
+	}
+
+	// Messages that would otherwise be skipped are not read past the fixed
+	// header.
+	body := []byte{0x00, 0x03, 'a', '/', 'b'}
+	skipTests := []struct {
+		Comment string
+		Header  []byte
+		Decode  func(r io.Reader) error
+	}{
+		{"DecodeOneMessage with invalid QoS", []byte{0x36, 0x80, 0x80, 0xe8, 0x5f}, func(r io.Reader) error {
+			_, err := DecodeOneMessage(r, opts)
+			return err
+		}},
+		{"DecodeOneMessage with reserved type", []byte{0xf0, 0x80, 0x80, 0xe8, 0x5f}, func(r io.Reader) error {
+			_, err := DecodeOneMessage(r, opts)
+			return err
+		}},
+		{"DecodeInto with unexpected type", []byte{0x40, 0x80, 0x80, 0xe8, 0x5f}, func(r io.Reader) error {
+			return DecodeInto(r, &Publish{}, opts)
+		}},
+		{"DecodeInto with invalid QoS", []byte{0x36, 0x80, 0x80, 0xe8, 0x5f}, func(r io.Reader) error {
+			return DecodeInto(r, &Publish{}, opts)
+		}},
+	}
+	for _, test := range skipTests {
+		r := bytes.NewBuffer(append(append([]byte{}, test.Header...), body...))
+		if err := test.Decode(r); !errors.Is(err, ErrPacketTooLarge) {
+			t.Errorf("%s: Expected error %v, got %v", test.Comment, ErrPacketTooLarge, err)
+		}
+		if r.Len() != len(body) {
+			t.Errorf("%s: Expected %d bytes left unread, got %d", test.Comment, len(body), r.Len())
+		}
+	}
+
+	d := NewDecoder(bytes.NewReader(append([]byte{0x36, 0x80, 0x80, 0xe8, 0x5f}, body...)))
+	d.Config = opts
+	if _, err := d.Decode(); !errors.Is(err, ErrPacketTooLarge) {
+		t.Errorf("Decoder: Expected error %v, got %v", ErrPacketTooLarge, err)
+	}
+
+	// A message within the limit decodes normally.
+	encoded = []byte{0x40, 0x02, 0x12, 0x34}
+	if _, err := DecodeOneMessage(bytes.NewBuffer(encoded), DecodeOptions{MaxRemainingLength: 2}); err != nil {
+		t.Errorf("Unexpected error decoding message within limit: %v", err)
+	}
+}
+
+func TestDecodeConnectFieldSpans(t *testing.T) {
+	msg := &Connect{
+		ProtocolName:    "MQIsdp",
+		ProtocolVersion: 3,
+		UsernameFlag:    true,
+		PasswordFlag:    true,
+		WillFlag:        true,
+		ClientId:        "xixihaha",
+		WillTopic:       "topic",
+		WillMessage:     "message",
+		Username:        "name",
+		Password:        "pwd",
+	}
+	encodedBuf := new(bytes.Buffer)
+	if err := msg.Encode(encodedBuf); err != nil {
+		t.Fatalf("Unexpected error during encoding: %v", err)
+	}
+	encoded := encodedBuf.Bytes()
+
+	decoded, err := DecodeOneMessage(bytes.NewBuffer(encoded), DecodeOptions{RecordConnectSpans: true})
+	if err != nil {
+		t.Fatalf("Unexpected error during decoding: %v", err)
+	}
+	spans := decoded.(*Connect).FieldSpans
+	if spans == nil {
+		t.Fatalf("Expected FieldSpans to be set")
+	}
+
+	tests := []struct {
+		Field string
+		Span  FieldSpan
+		Value string
+	}{
+		{"ClientId", spans.ClientId, msg.ClientId},
+		{"WillTopic", spans.WillTopic, msg.WillTopic},
+		{"WillMessage", spans.WillMessage, msg.WillMessage},
+		{"Username", spans.Username, msg.Username},
+		{"Password", spans.Password, msg.Password},
+	}
+	for _, test := range tests {
+		expected := append([]byte{0, byte(len(test.Value))}, test.Value...)
+		if end := test.Span.Offset + test.Span.Length; end > len(encoded) {
+			t.Errorf("%s: Span %+v exceeds message length %d", test.Field, test.Span, len(encoded))
+		} else if got := encoded[test.Span.Offset:end]; !bytes.Equal(expected, got) {
+			t.Errorf("%s: Span %+v contains %q, expected %q", test.Field, test.Span, got, expected)
+		}
+	}
+
+	if decoded, err := DecodeOneMessage(bytes.NewBuffer(encoded), nil); err != nil {
+		t.Errorf("Unexpected error during decoding: %v", err)
+	} else if spans := decoded.(*Connect).FieldSpans; spans != nil {
+		t.Errorf("Expected nil FieldSpans without RecordConnectSpans, got %+v", spans)
+	}
+}
+
+func TestDecoder(t *testing.T) {
+	msgs := []Message{
+		&Publish{TopicName: "a/b", Payload: BytesPayload{1, 2, 3}},
+		&PubAck{MessageId: 0x1234},
+		&PingReq{},
+	}
+	encodedBuf := new(bytes.Buffer)
+	for _, msg := range msgs {
+		if err := msg.Encode(encodedBuf); err != nil {
+			t.Fatalf("Unexpected error during encoding: %v", err)
+		}
+	}
+
+	d := NewDecoder(encodedBuf)
+	for i, expected := range msgs {
+		if msg, err := d.Decode(); err != nil {
+			t.Errorf("Message %d: Unexpected error during decoding: %v", i, err)
+		} else if !reflect.DeepEqual(expected, msg) {
+			t.Errorf("Message %d: Decoded value mismatch\n     got = %#v\nexpected = %#v", i, msg, expected)
+		}
+	}
+	if _, err := d.Decode(); err != io.EOF {
+		t.Errorf("Expected io.EOF at end of stream, got %v", err)
+	}
+}
+
+func TestDecoderMaxPackets(t *testing.T) {
+	encoded := bytes.Repeat([]byte{0xc0, 0x00}, 10)
+	d := NewDecoder(bytes.NewReader(encoded))
+	d.MaxPackets = 3
+	for i := 0; i < 3; i++ {
+		if _, err := d.Decode(); err != nil {
+			t.Errorf("Message %d: Unexpected error during decoding: %v", i, err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := d.Decode(); err != ErrMaxPackets {
+			t.Errorf("Expected error %v after 3 messages, got %v", ErrMaxPackets, err)
+		}
+	}
+}
+
+func TestDecoderProtocolVersion(t *testing.T) {
+	// A v5 PUBLISH with a Topic Alias property, which is parsed as payload
+	// when decoding for earlier versions.
+	publish := []byte{0x30, 0x0a, 0x00, 0x03, 'a', '/', 'b', 0x03, 0x23, 0x00, 0x05, 0x01}
+	alias := uint16(5)
+	encoded := append(append([]byte{}, publish...), publish...)
+
+	d := NewDecoder(bytes.NewBuffer(encoded))
+	v3Expected := &Publish{TopicName: "a/b", Payload: BytesPayload{0x03, 0x23, 0x00, 0x05, 0x01}}
+	if msg, err := d.Decode(); err != nil {
+		t.Errorf("Unexpected error decoding as v3: %v", err)
+	} else if !reflect.DeepEqual(v3Expected, msg) {
+		t.Errorf("Decoded value mismatch\n     got = %#v\nexpected = %#v", msg, v3Expected)
+	}
+
+	d.Config = DecodeOptions{ProtocolVersion: 5}
+	v5Expected := &Publish{TopicName: "a/b", Properties: &Properties{TopicAlias: &alias}, Payload: BytesPayload{0x01}}
+	if msg, err := d.Decode(); err != nil {
+		t.Errorf("Unexpected error decoding as v5: %v", err)
+	} else if !reflect.DeepEqual(v5Expected, msg) {
+		t.Errorf("Decoded value mismatch\n     got = %#v\nexpected = %#v", msg, v5Expected)
+	}
+}
+
+func TestNewDecoderBufioReader(t *testing.T) {
+	// A small buffer, which bufio.NewReader would wrap in a larger one.
+	br := bufio.NewReaderSize(bytes.NewReader([]byte{0xc0, 0x00}), 16)
+	d := NewDecoder(br)
+	if d.r.r != br {
+		t.Errorf("NewDecoder wrapped the *bufio.Reader rather than using it directly")
+	}
+	if msg, err := d.Decode(); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	} else if !reflect.DeepEqual(&PingReq{}, msg) {
+		t.Errorf("Decoded value mismatch\n     got = %#v\nexpected = %#v", msg, &PingReq{})
+	}
+}
+
+func TestDecoderStats(t *testing.T) {
+	stream := []byte{
+		0x30, 0x05, 0x00, 0x01, 'a', 0x01, 0x02, // PUBLISH
+		0x40, 0x02, 0x12, 0x34, // PUBACK
+		0x40, 0x02, 0x12, 0x35, // PUBACK
+		0xc0, 0x01, 0x00, // PINGREQ with trailing bytes
+		0x00, 0x00, // Reserved message type
+		0xc0, 0x00, // PINGREQ
+	}
+	d := NewDecoder(bytes.NewReader(stream))
+	for {
+		if _, err := d.Decode(); err == io.EOF {
+			break
+		}
+	}
+
+	expected := DecoderStats{Messages: 4, Errors: 2, Bytes: uint64(len(stream))}
+	expected.ByType[MsgPublish] = 1
+	expected.ByType[MsgPubAck] = 2
+	expected.ByType[MsgPingReq] = 1
+	if stats := d.Stats(); stats != expected {
+		t.Errorf("Stats mismatch\n     got = %+v\nexpected = %+v", stats, expected)
+	}
+
+	// Ending within a message counts as an error.
+	d = NewDecoder(bytes.NewReader([]byte{0x40, 0x02, 0x12}))
+	if _, err := d.Decode(); err == nil {
+		t.Errorf("Expected error decoding truncated message")
+	}
+	if stats := d.Stats(); stats.Errors != 1 || stats.Messages != 0 || stats.Bytes != 3 {
+		t.Errorf("Unexpected stats after truncated message: %+v", stats)
+	}
+}
+
+func TestDecoderPacketTimeout(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	d := NewDecoder(server)
+	d.PacketTimeout = 50 * time.Millisecond
+
+	// Idling for longer than the timeout before a message starts is allowed.
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		client.Write([]byte{0x40, 0x02, 0x12, 0x34})
+	}()
+	if msg, err := d.Decode(); err != nil {
+		t.Errorf("Unexpected error after idling: %v", err)
+	} else if !reflect.DeepEqual(&PubAck{MessageId: 0x1234}, msg) {
+		t.Errorf("Unexpected message after idling: %#v", msg)
+	}
+
+	// Stalling after the fixed header times out.
+	go client.Write([]byte{0x40, 0x02})
+	if _, err := d.Decode(); err != ErrPacketTimeout {
+		t.Errorf("Expected error %v, got %v", ErrPacketTimeout, err)
+	}
+}
+
+func TestEncodeFramed(t *testing.T) {
+	msgs := []Message{
+		&Publish{TopicName: "a/b", Payload: BytesPayload{1, 2, 3}},
+		&PubAck{MessageId: 0x1234},
+	}
+	framedBuf := new(bytes.Buffer)
+	for _, msg := range msgs {
+		if err := EncodeFramed(framedBuf, msg, 2); err != nil {
+			t.Fatalf("Unexpected error during encoding: %v", err)
+		}
+	}
+
+	for i, expected := range msgs {
+		var prefix [2]byte
+		if _, err := io.ReadFull(framedBuf, prefix[:]); err != nil {
+			t.Fatalf("Message %d: Unexpected error reading prefix: %v", i, err)
+		}
+		length := int(prefix[0])<<8 | int(prefix[1])
+		frame := bytes.NewBuffer(framedBuf.Next(length))
+
+		if msg, err := DecodeOneMessage(frame, nil); err != nil {
+			t.Errorf("Message %d: Unexpected error during decoding: %v", i, err)
+		} else if !reflect.DeepEqual(expected, msg) {
+			t.Errorf("Message %d: Decoded value mismatch\n     got = %#v\nexpected = %#v", i, msg, expected)
+		} else if frame.Len() != 0 {
+			t.Errorf("Message %d: %d bytes left in frame", i, frame.Len())
 		}
 	}
 }
 
-type SeqBytePayload struct {
-	N int
-	T *testing.T
+func TestEncodeFramedErrors(t *testing.T) {
+	msg := &Publish{TopicName: "a/b", Payload: make(BytesPayload, 256)}
+
+	w := new(bytes.Buffer)
+	if err := EncodeFramed(w, msg, 1); !errors.Is(err, ErrFrameTooLong) {
+		t.Errorf("Expected error %v, got %v", ErrFrameTooLong, err)
+	}
+	if err := EncodeFramed(w, msg, 3); !errors.Is(err, ErrBadFramePrefixWidth) {
+		t.Errorf("Expected error %v, got %v", ErrBadFramePrefixWidth, err)
+	}
+	if w.Len() != 0 {
+		t.Errorf("Expected nothing to be written, got %d bytes", w.Len())
+	}
 }
 
-func (p *SeqBytePayload) Size() int {
-	return p.N
+func TestChecksummedDecoder(t *testing.T) {
+	msgs := []Message{
+		&Publish{TopicName: "a/b", Payload: BytesPayload{1, 2, 3}},
+		&PubAck{MessageId: 0x1234},
+		&PingReq{},
+	}
+	encodedBuf := new(bytes.Buffer)
+	for _, msg := range msgs {
+		if err := EncodeChecksummed(encodedBuf, msg, crc32.NewIEEE()); err != nil {
+			t.Fatalf("Unexpected error during encoding: %v", err)
+		}
+	}
+	encoded := encodedBuf.Bytes()
+
+	// PUBLISH followed by its CRC32.
+	if len(encoded) < 14 || !bytes.Equal(encoded[10:14], []byte{0xba, 0xa2, 0x50, 0x66}) {
+		t.Fatalf("Unexpected encoding: %#v", encoded)
+	}
+
+	d := NewChecksummedDecoder(bytes.NewReader(encoded), crc32.NewIEEE())
+	for i, expected := range msgs {
+		if msg, err := d.Decode(); err != nil {
+			t.Errorf("Message %d: Unexpected error: %v", i, err)
+		} else if !reflect.DeepEqual(expected, msg) {
+			t.Errorf("Message %d: Decoded value mismatch\n     got = %#v\nexpected = %#v", i, msg, expected)
+		}
+	}
+	if _, err := d.Decode(); err != io.EOF {
+		t.Errorf("Expected io.EOF at end of stream, got %v", err)
+	}
+
+	// Corrupting the PUBLISH payload fails the checksum, and decoding resumes
+	// with the next message.
+	corrupted := append([]byte(nil), encoded...)
+	corrupted[8] ^= 0xff
+	d = NewChecksummedDecoder(bytes.NewReader(corrupted), crc32.NewIEEE())
+	if _, err := d.Decode(); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("Expected error %v, got %v", ErrChecksumMismatch, err)
+	}
+	if msg, err := d.Decode(); err != nil || !reflect.DeepEqual(msgs[1], msg) {
+		t.Errorf("Expected %#v after corrupted message, got %#v, %v", msgs[1], msg, err)
+	}
+
+	// A message with invalid QoS bits is skipped along with its checksum.
+	badQos := []byte{0x36, 0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+	d = NewChecksummedDecoder(bytes.NewReader(append(badQos, encoded[len(encoded)-6:]...)), crc32.NewIEEE())
+	if _, err := d.Decode(); !errors.Is(err, ErrBadQos) {
+		t.Errorf("Expected error %v, got %v", ErrBadQos, err)
+	}
+	if msg, err := d.Decode(); err != nil || !reflect.DeepEqual(msgs[2], msg) {
+		t.Errorf("Expected %#v after bad QoS, got %#v, %v", msgs[2], msg, err)
+	}
+
+	// Unless it is longer than MaxRemainingLength.
+	d = NewChecksummedDecoder(bytes.NewReader(badQos), crc32.NewIEEE())
+	d.Config = DecodeOptions{MaxRemainingLength: 1}
+	if _, err := d.Decode(); !errors.Is(err, ErrPacketTooLarge) {
+		t.Errorf("Expected error %v, got %v", ErrPacketTooLarge, err)
+	}
 }
 
-func (p *SeqBytePayload) WritePayload(w io.Writer) error {
-	buf := make([]byte, 256)
-	for i := range buf {
-		buf[i] = byte(i)
+func TestBytesNeeded(t *testing.T) {
+	tests := []struct {
+		Comment  string
+		Buffered []byte
+		N        int
+		Known    bool
+	}{
+		{"empty", nil, 1, false},
+		{"first byte only", []byte{0x30}, 1, false},
+		{"partial length", []byte{0x30, 0x80}, 1, false},
+		{"partial 4 byte length", []byte{0x30, 0x80, 0x80, 0x80}, 1, false},
+		{"zero length", []byte{0xc0, 0x00}, 0, true},
+		{"header only", []byte{0x40, 0x02}, 2, true},
+		{"partial body", []byte{0x40, 0x02, 0x12}, 1, true},
+		{"complete", []byte{0x40, 0x02, 0x12, 0x34}, 0, true},
+		{"complete with more", []byte{0x40, 0x02, 0x12, 0x34, 0xc0}, 0, true},
+		{"2 byte length", []byte{0x30, 0x80, 0x01}, 128, true},
+		{"4 byte length", []byte{0x30, 0xff, 0xff, 0xff, 0x7f, 0x00}, MaxPayloadSize - 1, true},
+		{"bad length", []byte{0x30, 0xff, 0xff, 0xff, 0xff}, 0, true},
 	}
 
-	for toWrite := p.N; toWrite > 0; toWrite -= 256 {
-		writeThisTime := toWrite
-		if writeThisTime > 256 {
-			writeThisTime = 256
+	for _, test := range tests {
+		if n, known := BytesNeeded(test.Buffered); n != test.N || known != test.Known {
+			t.Errorf("%s: Expected (%d, %t), got (%d, %t)", test.Comment, test.N, test.Known, n, known)
 		}
-		if _, err := w.Write(buf[:writeThisTime]); err != nil {
-			return err
+	}
+}
+
+func TestIsComplete(t *testing.T) {
+	tests := []struct {
+		Comment  string
+		B        []byte
+		Complete bool
+		Size     int
+		Err      error
+	}{
+		{"empty", nil, false, 0, nil},
+		{"partial length", []byte{0x30, 0x80}, false, 0, nil},
+		{"header only", []byte{0x40, 0x02}, false, 4, nil},
+		{"complete", []byte{0x40, 0x02, 0x12, 0x34}, true, 4, nil},
+		{"complete with more", []byte{0x40, 0x02, 0x12, 0x34, 0xc0}, true, 4, nil},
+		{"zero length", []byte{0xc0, 0x00}, true, 2, nil},
+		{"malformed length", []byte{0x30, 0xff, 0xff, 0xff, 0xff, 0x01}, false, 0, ErrBadLengthEncoding},
+	}
+
+	for _, test := range tests {
+		complete, size, err := IsComplete(test.B)
+		if complete != test.Complete || size != test.Size || err != test.Err {
+			t.Errorf("%s: Expected (%t, %d, %v), got (%t, %d, %v)", test.Comment,
+				test.Complete, test.Size, test.Err, complete, size, err)
 		}
 	}
-	return nil
 }
 
-func (p *SeqBytePayload) ReadPayload(r io.Reader) error {
-	buf := make([]byte, 256)
+func TestEncoder(t *testing.T) {
+	msgs := []Message{
+		&Connect{ProtocolName: "MQIsdp", ProtocolVersion: 3, ClientId: "xixihaha"},
+		&Publish{TopicName: "a/b", Payload: BytesPayload{1, 2, 3}},
+		&Subscribe{
+			Header:    Header{QosLevel: QosAtLeastOnce},
+			MessageId: 0x4321,
+			Topics:    []TopicQos{{"a/b", QosAtLeastOnce}},
+		},
+		&Disconnect{},
+	}
 
-	for toRead := p.N; toRead > 0; toRead -= 256 {
-		readThisTime := toRead
-		if readThisTime > 256 {
-			readThisTime = 256
+	encodedBuf := new(bytes.Buffer)
+	e := NewEncoder(encodedBuf)
+	for _, msg := range msgs {
+		if err := e.Encode(msg); err != nil {
+			t.Fatalf("Unexpected error during encoding: %v", err)
 		}
-		if _, err := io.ReadFull(r, buf[:readThisTime]); err != nil {
-			p.T.Errorf("Got unexpected error %v", err)
-			return err
+	}
+	if encodedBuf.Len() != 0 {
+		t.Errorf("Expected no data before Flush, got %d bytes", encodedBuf.Len())
+	}
+	if err := e.Flush(); err != nil {
+		t.Fatalf("Unexpected error during Flush: %v", err)
+	}
+
+	d := NewDecoder(encodedBuf)
+	for i, expected := range msgs {
+		if msg, err := d.Decode(); err != nil {
+			t.Errorf("Message %d: Unexpected error during decoding: %v", i, err)
+		} else if !reflect.DeepEqual(expected, msg) {
+			t.Errorf("Message %d: Decoded value mismatch\n     got = %#v\nexpected = %#v", i, msg, expected)
 		}
-		for i, v := range buf[:readThisTime] {
-			if v != byte(i) {
-				p.T.Errorf("Got unexpected byte %#x, expected %#x", v, i)
-				return io.ErrClosedPipe
+	}
+	if _, err := d.Decode(); err != io.EOF {
+		t.Errorf("Expected io.EOF at end of stream, got %v", err)
+	}
+}
+
+func TestPublishBuilder(t *testing.T) {
+	tests := []struct {
+		Comment  string
+		Builder  *PublishBuilder
+		Expected *Publish
+		Err      error
+	}{
+		{
+			Comment:  "QoS 0",
+			Builder:  NewPublishBuilder("a/b").Payload(BytesPayload{1, 2, 3}),
+			Expected: &Publish{TopicName: "a/b", Payload: BytesPayload{1, 2, 3}},
+		},
+		{
+			Comment: "QoS 2 with all flags",
+			Builder: NewPublishBuilder("a/b").Qos(QosExactlyOnce).MessageId(0x1234).Retain(true).Dup(true),
+			Expected: &Publish{
+				Header:    Header{DupFlag: true, QosLevel: QosExactlyOnce, Retain: true},
+				TopicName: "a/b",
+				MessageId: 0x1234,
+				Payload:   BytesPayload{},
+			},
+		},
+		{
+			Comment: "QoS 0 with message ID",
+			Builder: NewPublishBuilder("a/b").MessageId(0x1234),
+			Err:     ErrMessageIdOnQos0,
+		},
+		{
+			Comment: "QoS 1 without message ID",
+			Builder: NewPublishBuilder("a/b").Qos(QosAtLeastOnce),
+			Err:     ErrMissingMessageId,
+		},
+		{
+			Comment: "invalid QoS",
+			Builder: NewPublishBuilder("a/b").Qos(3).MessageId(0x1234),
+			Err:     ErrBadQos,
+		},
+		{
+			Comment: "DUP on QoS 0",
+			Builder: NewPublishBuilder("a/b").Dup(true),
+			Err:     ErrDupOnQos0,
+		},
+	}
+
+	for _, test := range tests {
+		msg, err := test.Builder.Build()
+		if test.Err != nil {
+			if !errors.Is(err, test.Err) {
+				t.Errorf("%s: Expected error %v, got %v", test.Comment, test.Err, err)
 			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: Unexpected error: %v", test.Comment, err)
+		} else if !reflect.DeepEqual(test.Expected, msg) {
+			t.Errorf("%s: Built value mismatch\n     got = %#v\nexpected = %#v", test.Comment, msg, test.Expected)
 		}
 	}
+}
 
-	// Any more reads should produce an EOF.
-	if n, err := r.Read(buf); n > 0 {
-		p.T.Errorf("Got unexpected extra %d bytes of data", n)
-	} else if err != io.EOF {
-		p.T.Errorf("Expected err=EOF, got %v", err)
+func TestNew(t *testing.T) {
+	tests := []struct {
+		Comment  string
+		Type     MessageType
+		Opts     []Option
+		Expected Message
+		Err      error
+	}{
+		{
+			Comment: "CONNECT",
+			Type:    MsgConnect,
+			Opts:    []Option{OptClientId("client"), OptKeepAlive(30), OptCleanSession(true)},
+			Expected: &Connect{
+				ProtocolName:    "MQTT",
+				ProtocolVersion: 4,
+				CleanSession:    true,
+				KeepAliveTimer:  30,
+				ClientId:        "client",
+			},
+		},
+		{
+			Comment: "PUBLISH",
+			Type:    MsgPublish,
+			Opts: []Option{
+				OptTopic("a/b"), OptQos(QosAtLeastOnce), OptMessageId(0x1234),
+				OptRetain(true), OptPayload(BytesPayload{1, 2, 3}),
+			},
+			Expected: &Publish{
+				Header:    Header{QosLevel: QosAtLeastOnce, Retain: true},
+				TopicName: "a/b",
+				MessageId: 0x1234,
+				Payload:   BytesPayload{1, 2, 3},
+			},
+		},
+		{
+			Comment:  "PUBACK",
+			Type:     MsgPubAck,
+			Opts:     []Option{OptMessageId(0x1234)},
+			Expected: NewPubAck(0x1234),
+		},
+		{
+			Comment: "message ID on QoS 0 PUBLISH",
+			Type:    MsgPublish,
+			Opts:    []Option{OptTopic("a/b"), OptMessageId(0x1234)},
+			Err:     ErrMessageIdOnQos0,
+		},
+		{
+			Comment: "QoS 0 after message ID",
+			Type:    MsgPublish,
+			Opts:    []Option{OptQos(QosAtLeastOnce), OptMessageId(0x1234), OptQos(QosAtMostOnce)},
+			Err:     ErrMessageIdOnQos0,
+		},
+		{
+			Comment: "QoS 1 PUBLISH without message ID",
+			Type:    MsgPublish,
+			Opts:    []Option{OptTopic("a/b"), OptQos(QosAtLeastOnce)},
+			Err:     ErrMissingMessageId,
+		},
+		{
+			Comment: "zero message ID",
+			Type:    MsgPubAck,
+			Opts:    []Option{OptMessageId(0)},
+			Err:     ErrMissingMessageId,
+		},
+		{
+			Comment: "topic on CONNECT",
+			Type:    MsgConnect,
+			Opts:    []Option{OptTopic("a/b")},
+			Err:     ErrOptionNotApplicable,
+		},
+		{
+			Comment: "message ID on PINGREQ",
+			Type:    MsgPingReq,
+			Opts:    []Option{OptMessageId(0x1234)},
+			Err:     ErrOptionNotApplicable,
+		},
+		{
+			Comment: "invalid message type",
+			Type:    MessageType(0),
+			Err:     ErrBadMsgType,
+		},
 	}
 
-	return nil
+	for _, test := range tests {
+		msg, err := New(test.Type, test.Opts...)
+		if test.Err != nil {
+			if !errors.Is(err, test.Err) {
+				t.Errorf("%s: Expected error %v, got %v", test.Comment, test.Err, err)
+			}
+		} else if err != nil {
+			t.Errorf("%s: Unexpected error: %v", test.Comment, err)
+		} else if !reflect.DeepEqual(test.Expected, msg) {
+			t.Errorf("%s: Value mismatch\n     got = %#v\nexpected = %#v", test.Comment, msg, test.Expected)
+		}
+	}
 }
 
-// Stream a reasonably large Publish payload containing sequential byte values.
-func TestPipedPublish(t *testing.T) {
-	r, w := io.Pipe()
+func TestPublishShallowDeliveryClone(t *testing.T) {
+	msg := &Publish{
+		Header:    Header{QosLevel: QosExactlyOnce},
+		TopicName: "a/b",
+		MessageId: 0x1234,
+		Payload:   BytesPayload{1, 2, 3},
+	}
 
-	complete := make(chan bool)
+	clone := msg.ShallowDeliveryClone()
+	clone.Header.QosLevel = QosAtLeastOnce
+	clone.MessageId = 0x4321
 
-	payload := &SeqBytePayload{
-		N: 20 + (1 << 20),
-		T: t,
+	if msg.Header.QosLevel != QosExactlyOnce || msg.MessageId != 0x1234 {
+		t.Errorf("Original modified by changes to clone: %#v", msg)
+	}
+	if clone.TopicName != msg.TopicName {
+		t.Errorf("Expected clone TopicName %q, got %q", msg.TopicName, clone.TopicName)
+	}
+	original, cloned := msg.Payload.(BytesPayload), clone.Payload.(BytesPayload)
+	if len(original) != len(cloned) || &original[0] != &cloned[0] {
+		t.Errorf("Expected clone to share Payload data")
 	}
+}
 
-	go func() {
-		defer func() {
-			complete <- true
-			w.Close()
-		}()
+func TestDecoderMalformedMessages(t *testing.T) {
+	d := NewDecoder(bytes.NewBuffer([]byte{
+		0x40, 0x01, 0x12, // PUBACK with too short a length.
+		0x40, 0x03, 0x12, 0x34, 0x56, // PUBACK with too long a length.
+		0x00, 0x02, 0x12, 0x34, // Reserved message type.
+		0x36, 0x02, 0x00, 0x00, // PUBLISH with QoS = 3.
+		0x40, 0x02, 0x43, 0x21, // PUBACK.
+	}))
 
-		msg := &Publish{
-			TopicName: "foo",
-			Payload:   payload,
+	expectedErrs := []error{ErrDataExceedsPacket, ErrTrailingBytes, ErrBadMsgType, ErrBadQos}
+	for _, expectedErr := range expectedErrs {
+		if _, err := d.Decode(); !errors.Is(err, expectedErr) {
+			t.Errorf("Expected error %v, got %v", expectedErr, err)
 		}
-		if err := msg.Encode(w); err != nil {
-			t.Error(err)
+	}
+
+	expected := &PubAck{MessageId: 0x4321}
+	if msg, err := d.Decode(); err != nil {
+		t.Errorf("Unexpected error decoding message after malformed messages: %v", err)
+	} else if !reflect.DeepEqual(expected, msg) {
+		t.Errorf("Decoded value mismatch\n     got = %#v\nexpected = %#v", msg, expected)
+	}
+}
+
+func TestDecoderTruncatedMessage(t *testing.T) {
+	d := NewDecoder(bytes.NewBuffer([]byte{
+		0x40, 0x04, 0x12, 0x34, 0x56, // PUBACK whose body is cut short.
+	}))
+
+	if _, err := d.Decode(); !errors.Is(err, ErrTrailingBytes) {
+		t.Errorf("Expected error %v, got %v", ErrTrailingBytes, err)
+	}
+	if _, err := d.Decode(); err != io.ErrUnexpectedEOF {
+		t.Errorf("Expected error %v, got %v", io.ErrUnexpectedEOF, err)
+	}
+	if _, err := d.Decode(); err != io.EOF {
+		t.Errorf("Expected io.EOF at end of stream, got %v", err)
+	}
+}
+
+func TestHeaderIsRetransmit(t *testing.T) {
+	tests := []struct {
+		Header   Header
+		Expected bool
+	}{
+		{Header{QosLevel: QosAtMostOnce}, false},
+		{Header{QosLevel: QosAtLeastOnce}, false},
+		{Header{DupFlag: true, QosLevel: QosAtMostOnce}, false},
+		{Header{DupFlag: true, QosLevel: QosAtLeastOnce}, true},
+		{Header{DupFlag: true, QosLevel: QosExactlyOnce}, true},
+	}
+
+	for _, test := range tests {
+		if got := test.Header.IsRetransmit(); got != test.Expected {
+			t.Errorf("%+v: Expected IsRetransmit() = %t, got %t", test.Header, test.Expected, got)
 		}
-	}()
+	}
+}
 
-	go func() {
-		defer func() {
-			complete <- true
-			r.Close()
-		}()
+func TestMessageTypePredicates(t *testing.T) {
+	tests := []struct {
+		MsgType                               MessageType
+		IsAck, CarriesMessageId, HasTopicList bool
+	}{
+		{MsgConnect, false, false, false},
+		{MsgConnAck, true, false, false},
+		{MsgPublish, false, true, false},
+		{MsgPubAck, true, true, false},
+		{MsgPubRec, true, true, false},
+		{MsgPubRel, true, true, false},
+		{MsgPubComp, true, true, false},
+		{MsgSubscribe, false, true, true},
+		{MsgSubAck, true, true, false},
+		{MsgUnsubscribe, false, true, true},
+		{MsgUnsubAck, true, true, false},
+		{MsgPingReq, false, false, false},
+		{MsgPingResp, false, false, false},
+		{MsgDisconnect, false, false, false},
+	}
 
-		expectedMsg := &Publish{
-			TopicName: "foo",
-			Payload:   payload,
+	for _, test := range tests {
+		if got := test.MsgType.IsAck(); got != test.IsAck {
+			t.Errorf("Message type %d: Expected IsAck() = %t, got %t", test.MsgType, test.IsAck, got)
+		}
+		if got := test.MsgType.CarriesMessageId(); got != test.CarriesMessageId {
+			t.Errorf("Message type %d: Expected CarriesMessageId() = %t, got %t", test.MsgType, test.CarriesMessageId, got)
+		}
+		if got := test.MsgType.HasTopicList(); got != test.HasTopicList {
+			t.Errorf("Message type %d: Expected HasTopicList() = %t, got %t", test.MsgType, test.HasTopicList, got)
 		}
+	}
+}
 
-		testConfig := &ValueConfig{payload}
+// TestDecodeLargePayload checks that DefaultDecoderConfig decodes payloads
+// that are too large to be allocated up front, and that a truncated message
+// claiming such a payload fails without allocating it.
+func TestDecodeLargePayload(t *testing.T) {
+	msg := &Publish{TopicName: "a", Payload: make(BytesPayload, maxPreallocatedPayload+1)}
+	for i := range msg.Payload.(BytesPayload) {
+		msg.Payload.(BytesPayload)[i] = byte(i)
+	}
+	encodedBuf := new(bytes.Buffer)
+	if err := msg.Encode(encodedBuf); err != nil {
+		t.Fatalf("Unexpected error during encoding: %v", err)
+	}
+	decodedMsg, err := DecodeOneMessage(bytes.NewReader(encodedBuf.Bytes()), nil)
+	if err != nil {
+		t.Fatalf("Unexpected error during decoding: %v", err)
+	}
+	if !reflect.DeepEqual(msg, decodedMsg) {
+		t.Errorf("Decoded message differs from the encoded message")
+	}
 
-		if msg, err := DecodeOneMessage(r, testConfig); err != nil {
-			t.Error(err)
-		} else if !reflect.DeepEqual(expectedMsg, msg) {
-			t.Errorf("     got = %#v\nexpected = %#v", msg, expectedMsg)
+	// PUBLISH claiming the maximum remaining length, with only the topic name.
+	truncated := []byte{0x30, 0xff, 0xff, 0xff, 0x7f, 0x00, 0x01, 'a'}
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	if _, err := DecodeOneMessage(bytes.NewReader(truncated), nil); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("Expected error %v, got %v", io.ErrUnexpectedEOF, err)
+	}
+	runtime.ReadMemStats(&after)
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+		t.Errorf("Decoding the truncated message allocated %d bytes", allocated)
+	}
+}
+
+// discardDecoderConfig discards Publish payloads by streaming them to
+// io.Discard.
+type discardDecoderConfig struct{}
+
+func (c discardDecoderConfig) MakePayload(msg *Publish, r io.Reader, n int) (Payload, error) {
+	return &StreamedPayload{DecodingSink: io.Discard}, nil
+}
+
+func FuzzDecode(f *testing.F) {
+	seeds := []Message{
+		&Connect{
+			ProtocolName:    "MQIsdp",
+			ProtocolVersion: 3,
+			UsernameFlag:    true,
+			PasswordFlag:    true,
+			WillFlag:        true,
+			WillQos:         QosAtLeastOnce,
+			ClientId:        "xixihaha",
+			WillTopic:       "topic",
+			WillMessage:     "message",
+			Username:        "name",
+			Password:        "pwd",
+		},
+		&ConnAck{ReturnCode: RetCodeAccepted},
+		&Publish{TopicName: "a/b", Payload: BytesPayload{1, 2, 3}},
+		&Publish{
+			Header:    Header{QosLevel: QosExactlyOnce},
+			TopicName: "a/b",
+			MessageId: 0x1234,
+			Payload:   BytesPayload{1, 2, 3},
+		},
+		&PubAck{MessageId: 0x1234},
+		&PubRec{MessageId: 0x1234},
+		&PubRel{Header: Header{QosLevel: QosAtLeastOnce}, MessageId: 0x1234},
+		&PubComp{MessageId: 0x1234},
+		&Subscribe{
+			Header:    Header{QosLevel: QosAtLeastOnce},
+			MessageId: 0x4321,
+			Topics:    []TopicQos{{"a/b", QosAtLeastOnce}, {"c/d", QosExactlyOnce}},
+		},
+		&SubAck{MessageId: 0x4321, TopicsQos: []QosLevel{QosAtLeastOnce, QosExactlyOnce}},
+		&Unsubscribe{
+			Header:    Header{QosLevel: QosAtLeastOnce},
+			MessageId: 0x4321,
+			Topics:    []string{"a/b", "c/d"},
+		},
+		&UnsubAck{MessageId: 0x4321},
+		&PingReq{},
+		&PingResp{},
+		&Disconnect{},
+	}
+	for _, msg := range seeds {
+		encodedBuf := new(bytes.Buffer)
+		if err := msg.Encode(encodedBuf); err != nil {
+			f.Fatalf("Unexpected error encoding seed %#v: %v", msg, err)
 		}
-	}()
+		f.Add(encodedBuf.Bytes())
+	}
 
-	_ = <-complete
-	_ = <-complete
+	f.Fuzz(func(t *testing.T, data []byte) {
+		configs := []DecoderConfig{
+			nil,
+			DefaultDecoderConfig{},
+			discardDecoderConfig{},
+			DecodeOptions{Config: discardDecoderConfig{}, Strict: true, RecordConnectSpans: true},
+			DecodeOptions{MaxRemainingLength: 1024, ProtocolVersion: 5, MaxTopics: 4},
+		}
+		for _, config := range configs {
+			DecodeOneMessage(bytes.NewReader(data), config)
+
+			d := NewDecoder(bytes.NewReader(data))
+			d.Config = config
+			for {
+				if _, err := d.Decode(); errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+					break
+				}
+			}
+		}
+	})
 }
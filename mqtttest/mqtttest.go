@@ -0,0 +1,35 @@
+// Package mqtttest provides helpers for testing code that uses the mqtt
+// package.
+package mqtttest
+
+import (
+	"bytes"
+	"encoding/hex"
+	"reflect"
+	"testing"
+
+	"github.com/robertchildresscfa/mqtt"
+)
+
+// AssertDecodes decodes a single message from input using the default decoder
+// configuration, and reports an error on t if decoding fails, if input
+// contains more than the one message, or if the decoded message is not deeply
+// equal to want. Failure reports include both messages and a hex dump of
+// input.
+func AssertDecodes(t testing.TB, input []byte, want mqtt.Message) {
+	t.Helper()
+
+	r := bytes.NewReader(input)
+	got, err := mqtt.DecodeOneMessage(r, nil)
+	if err != nil {
+		t.Errorf("Unexpected error decoding message: %v\ninput:\n%s", err, hex.Dump(input))
+		return
+	}
+	if r.Len() != 0 {
+		t.Errorf("%d bytes of input remain after decoding message %#v\ninput:\n%s", r.Len(), got, hex.Dump(input))
+		return
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Decoded message does not match\n got: %#v\nwant: %#v\ninput:\n%s", got, want, hex.Dump(input))
+	}
+}
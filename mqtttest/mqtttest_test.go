@@ -0,0 +1,71 @@
+package mqtttest
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/robertchildresscfa/mqtt"
+)
+
+// fakeTB records errors reported to it rather than failing the test.
+type fakeTB struct {
+	testing.TB
+	errors []string
+}
+
+func (tb *fakeTB) Helper() {}
+
+func (tb *fakeTB) Errorf(format string, args ...interface{}) {
+	tb.errors = append(tb.errors, fmt.Sprintf(format, args...))
+}
+
+func TestAssertDecodes(t *testing.T) {
+	pubAck := []byte{0x40, 0x02, 0x12, 0x34}
+
+	AssertDecodes(t, pubAck, &mqtt.PubAck{MessageId: 0x1234})
+
+	tests := []struct {
+		Comment string
+		Input   []byte
+		Want    mqtt.Message
+		Report  string
+	}{
+		{
+			Comment: "different message ID",
+			Input:   pubAck,
+			Want:    &mqtt.PubAck{MessageId: 0x4321},
+			Report:  "does not match",
+		},
+		{
+			Comment: "different message type",
+			Input:   pubAck,
+			Want:    &mqtt.PubRec{MessageId: 0x1234},
+			Report:  "does not match",
+		},
+		{
+			Comment: "trailing input",
+			Input:   append(pubAck[:len(pubAck):len(pubAck)], 0xd0, 0x00),
+			Want:    &mqtt.PubAck{MessageId: 0x1234},
+			Report:  "remain after decoding",
+		},
+		{
+			Comment: "truncated input",
+			Input:   pubAck[:3],
+			Want:    &mqtt.PubAck{MessageId: 0x1234},
+			Report:  "error decoding",
+		},
+	}
+
+	for _, test := range tests {
+		tb := &fakeTB{}
+		AssertDecodes(tb, test.Input, test.Want)
+		if len(tb.errors) != 1 {
+			t.Errorf("%s: expected 1 error, got %d: %q", test.Comment, len(tb.errors), tb.errors)
+			continue
+		}
+		if !strings.Contains(tb.errors[0], test.Report) || !strings.Contains(tb.errors[0], "40 02 12") {
+			t.Errorf("%s: error report does not describe the failure:\n%s", test.Comment, tb.errors[0])
+		}
+	}
+}
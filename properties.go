@@ -0,0 +1,385 @@
+package mqtt
+
+import (
+	"bytes"
+	"io"
+)
+
+// MQTT 5.0 property identifiers.
+const (
+	propPayloadFormatIndicator = 0x01
+	propMessageExpiryInterval  = 0x02
+	propContentType            = 0x03
+	propResponseTopic          = 0x08
+	propCorrelationData        = 0x09
+	propSubscriptionIdentifier = 0x0b
+	propSessionExpiryInterval  = 0x11
+	propAuthenticationMethod   = 0x15
+	propAuthenticationData     = 0x16
+	propRequestProblemInfo     = 0x17
+	propWillDelayInterval      = 0x18
+	propRequestResponseInfo    = 0x19
+	propServerReference        = 0x1c
+	propReasonString           = 0x1f
+	propReceiveMaximum         = 0x21
+	propTopicAliasMaximum      = 0x22
+	propTopicAlias             = 0x23
+	propUserProperty           = 0x26
+	propMaximumPacketSize      = 0x27
+)
+
+// connectProperties, willProperties, publishProperties, ackProperties and
+// disconnectProperties are the properties that may appear in the CONNECT
+// properties, will properties, PUBLISH properties and the properties of
+// PUBACK, PUBREC, PUBREL and PUBCOMP, and DISCONNECT messages respectively.
+var (
+	connectProperties = []uint32{
+		propSessionExpiryInterval, propReceiveMaximum, propMaximumPacketSize,
+		propTopicAliasMaximum, propRequestResponseInfo, propRequestProblemInfo,
+		propUserProperty, propAuthenticationMethod, propAuthenticationData,
+	}
+	willProperties = []uint32{
+		propWillDelayInterval, propPayloadFormatIndicator, propMessageExpiryInterval,
+		propContentType, propResponseTopic, propCorrelationData, propUserProperty,
+	}
+	publishProperties = []uint32{
+		propPayloadFormatIndicator, propMessageExpiryInterval, propTopicAlias,
+		propResponseTopic, propCorrelationData, propUserProperty,
+		propSubscriptionIdentifier, propContentType,
+	}
+	ackProperties        = []uint32{propReasonString, propUserProperty}
+	disconnectProperties = []uint32{
+		propSessionExpiryInterval, propReasonString, propUserProperty, propServerReference,
+	}
+)
+
+// maxVarInt is the largest value that a variable byte integer can encode.
+const maxVarInt = 268435455
+
+// Properties holds the MQTT 5.0 properties of a PUBLISH message. Properties
+// that are absent are nil.
+type Properties struct {
+	PayloadFormatIndicator *uint8
+	MessageExpiryInterval  *uint32
+	TopicAlias             *uint16
+	ResponseTopic          *string
+	CorrelationData        []byte
+	// SubscriptionIdentifiers may only be set on PUBLISH messages sent by a
+	// server, and may repeat.
+	SubscriptionIdentifiers []uint32
+	ContentType             *string
+	// UserProperties may repeat the same key, and their order is preserved.
+	UserProperties []UserProperty
+}
+
+// UserProperty is an MQTT 5.0 User Property, an application defined name and
+// value.
+type UserProperty struct {
+	Key, Value string
+}
+
+// UserProperties returns the MQTT 5.0 User Properties of msg in the order
+// that they appear in the message, including any repeated keys. nil is
+// returned if msg has no properties.
+func (msg *Publish) UserProperties() []UserProperty {
+	if msg.Properties == nil {
+		return nil
+	}
+	return msg.Properties.UserProperties
+}
+
+// ContentType returns the MQTT 5.0 Content Type property of msg, which
+// describes its payload (such as a MIME type). ok is false if the property is
+// absent, including when msg was not decoded as MQTT 5.0.
+func (msg *Publish) ContentType() (contentType string, ok bool) {
+	if msg.Properties == nil || msg.Properties.ContentType == nil {
+		return "", false
+	}
+	return *msg.Properties.ContentType, true
+}
+
+// validate returns an error if p cannot be encoded.
+func (p *Properties) validate() error {
+	if p.TopicAlias != nil && *p.TopicAlias == 0 {
+		return ErrBadProperty
+	}
+	if len(p.CorrelationData) > 0xffff {
+		return ErrStringTooLong
+	}
+	for _, id := range p.SubscriptionIdentifiers {
+		if id == 0 || id > maxVarInt {
+			return ErrBadProperty
+		}
+	}
+
+	strs := make([]string, 0, 2+2*len(p.UserProperties))
+	if p.ResponseTopic != nil {
+		strs = append(strs, *p.ResponseTopic)
+	}
+	if p.ContentType != nil {
+		strs = append(strs, *p.ContentType)
+	}
+	for _, prop := range p.UserProperties {
+		strs = append(strs, prop.Key, prop.Value)
+	}
+	for _, val := range strs {
+		if err := validateUTF8String(val); err != nil {
+			return err
+		}
+	}
+
+	if p.size() > maxVarInt {
+		return ErrBadProperty
+	}
+	return nil
+}
+
+// size returns the number of bytes that the properties occupy, excluding the
+// property length.
+func (p *Properties) size() int64 {
+	var n int64
+	if p.PayloadFormatIndicator != nil {
+		n += 2
+	}
+	if p.MessageExpiryInterval != nil {
+		n += 5
+	}
+	if p.TopicAlias != nil {
+		n += 3
+	}
+	if p.ResponseTopic != nil {
+		n += 3 + int64(len(*p.ResponseTopic))
+	}
+	if p.CorrelationData != nil {
+		n += 3 + int64(len(p.CorrelationData))
+	}
+	for _, id := range p.SubscriptionIdentifiers {
+		n += 1 + int64(encodedLengthSize(int32(id)))
+	}
+	if p.ContentType != nil {
+		n += 3 + int64(len(*p.ContentType))
+	}
+	for _, prop := range p.UserProperties {
+		n += 5 + int64(len(prop.Key)) + int64(len(prop.Value))
+	}
+	return n
+}
+
+// encodedLen returns the number of bytes that encode writes.
+func (p *Properties) encodedLen() int64 {
+	size := p.size()
+	return int64(encodedLengthSize(int32(size))) + size
+}
+
+// encode writes the property length followed by the properties to buf.
+func (p *Properties) encode(buf *bytes.Buffer) {
+	encodeLength(int32(p.size()), buf)
+	p.encodeProperties(buf)
+}
+
+// encodeProperties writes the properties to buf, without the property length.
+func (p *Properties) encodeProperties(buf *bytes.Buffer) {
+	if p.PayloadFormatIndicator != nil {
+		setUint8(propPayloadFormatIndicator, buf)
+		setUint8(*p.PayloadFormatIndicator, buf)
+	}
+	if p.MessageExpiryInterval != nil {
+		setUint8(propMessageExpiryInterval, buf)
+		setUint32(*p.MessageExpiryInterval, buf)
+	}
+	if p.TopicAlias != nil {
+		setUint8(propTopicAlias, buf)
+		setUint16(*p.TopicAlias, buf)
+	}
+	if p.ResponseTopic != nil {
+		setUint8(propResponseTopic, buf)
+		setString(*p.ResponseTopic, buf)
+	}
+	if p.CorrelationData != nil {
+		setUint8(propCorrelationData, buf)
+		setString(string(p.CorrelationData), buf)
+	}
+	for _, id := range p.SubscriptionIdentifiers {
+		setUint8(propSubscriptionIdentifier, buf)
+		encodeLength(int32(id), buf)
+	}
+	if p.ContentType != nil {
+		setUint8(propContentType, buf)
+		setString(*p.ContentType, buf)
+	}
+	for _, prop := range p.UserProperties {
+		setUint8(propUserProperty, buf)
+		setString(prop.Key, buf)
+		setString(prop.Value, buf)
+	}
+}
+
+// getWillProperties reads a property length and the will properties that
+// follow it. The Will Delay Interval is returned separately from the other
+// properties, which are those that a will PUBLISH carries. ErrBadProperty is
+// raised for a property that is not allowed in the will properties, or a
+// repeated property that may only appear once.
+func getWillProperties(r io.Reader, packetRemaining *int32) (p *Properties, delay *uint32) {
+	p = new(Properties)
+	forEachProperty(r, packetRemaining, willProperties, func(id uint32, remaining *int32) {
+		if id != propWillDelayInterval {
+			p.getProperty(r, id, remaining)
+			return
+		}
+		if delay != nil {
+			raiseError(ErrBadProperty)
+		}
+		v := getUint32(r, remaining)
+		delay = &v
+	})
+	return p, delay
+}
+
+// getConnectProperties reads a property length and the CONNECT properties
+// that follow it. The Session Expiry Interval is returned if present, and the
+// other properties are skipped. ErrBadProperty is raised for a property that
+// is not allowed in the CONNECT properties, or a repeated Session Expiry
+// Interval.
+func getConnectProperties(r io.Reader, packetRemaining *int32) (sessionExpiry *uint32) {
+	forEachProperty(r, packetRemaining, connectProperties, func(id uint32, remaining *int32) {
+		if id != propSessionExpiryInterval {
+			skipPropertyValue(r, id, remaining)
+			return
+		}
+		if sessionExpiry != nil {
+			raiseError(ErrBadProperty)
+		}
+		v := getUint32(r, remaining)
+		sessionExpiry = &v
+	})
+	return sessionExpiry
+}
+
+// getDisconnectProperties reads a property length and the DISCONNECT
+// properties that follow it, returning the Reason String. The other
+// properties are skipped. ErrBadProperty is raised for a property that is not
+// allowed in a DISCONNECT, or a repeated Reason String.
+func getDisconnectProperties(r io.Reader, packetRemaining *int32) (reasonString string) {
+	seen := false
+	forEachProperty(r, packetRemaining, disconnectProperties, func(id uint32, remaining *int32) {
+		if id != propReasonString {
+			skipPropertyValue(r, id, remaining)
+			return
+		}
+		if seen {
+			raiseError(ErrBadProperty)
+		}
+		seen = true
+		reasonString = getString(r, remaining)
+	})
+	return reasonString
+}
+
+// forEachProperty reads a property length, and then calls read for each of the
+// properties that follow it to read the property value from r. remaining is
+// the length of the properties left to read. ErrBadProperty is raised for a
+// property that is not in allowed.
+func forEachProperty(r io.Reader, packetRemaining *int32, allowed []uint32, read func(id uint32, remaining *int32)) {
+	length := getVarInt(r, packetRemaining)
+	if int64(length) > int64(*packetRemaining) {
+		raiseError(ErrDataExceedsPacket)
+	}
+
+	remaining := int32(length)
+	defer func() {
+		*packetRemaining -= int32(length) - remaining
+	}()
+
+	for remaining > 0 {
+		id := getVarInt(r, &remaining)
+		known := false
+		for _, a := range allowed {
+			known = known || a == id
+		}
+		if !known {
+			raiseError(ErrBadProperty)
+		}
+		read(id, &remaining)
+	}
+}
+
+// getProperties reads a property length and the PUBLISH properties that
+// follow it. ErrBadProperty is raised for a property that is not allowed in a
+// PUBLISH, or repeated when it may only appear once.
+func getProperties(r io.Reader, packetRemaining *int32) *Properties {
+	p := new(Properties)
+	forEachProperty(r, packetRemaining, publishProperties, func(id uint32, remaining *int32) {
+		p.getProperty(r, id, remaining)
+	})
+	return p
+}
+
+// getProperty reads the value of the PUBLISH property id into p.
+// ErrBadProperty is raised for a property that is repeated when it may only
+// appear once.
+func (p *Properties) getProperty(r io.Reader, id uint32, remaining *int32) {
+	switch id {
+	case propPayloadFormatIndicator:
+		if p.PayloadFormatIndicator != nil {
+			raiseError(ErrBadProperty)
+		}
+		v := getUint8(r, remaining)
+		p.PayloadFormatIndicator = &v
+	case propMessageExpiryInterval:
+		if p.MessageExpiryInterval != nil {
+			raiseError(ErrBadProperty)
+		}
+		v := getUint32(r, remaining)
+		p.MessageExpiryInterval = &v
+	case propTopicAlias:
+		if p.TopicAlias != nil {
+			raiseError(ErrBadProperty)
+		}
+		v := getUint16(r, remaining)
+		p.TopicAlias = &v
+	case propResponseTopic:
+		if p.ResponseTopic != nil {
+			raiseError(ErrBadProperty)
+		}
+		v := getString(r, remaining)
+		p.ResponseTopic = &v
+	case propCorrelationData:
+		if p.CorrelationData != nil {
+			raiseError(ErrBadProperty)
+		}
+		p.CorrelationData = getBinary(r, remaining)
+	case propSubscriptionIdentifier:
+		p.SubscriptionIdentifiers = append(p.SubscriptionIdentifiers, getVarInt(r, remaining))
+	case propContentType:
+		if p.ContentType != nil {
+			raiseError(ErrBadProperty)
+		}
+		v := getString(r, remaining)
+		p.ContentType = &v
+	case propUserProperty:
+		key := getString(r, remaining)
+		value := getString(r, remaining)
+		p.UserProperties = append(p.UserProperties, UserProperty{Key: key, Value: value})
+	}
+}
+
+// skipPropertyValue reads and discards the value of a CONNECT or DISCONNECT
+// property.
+func skipPropertyValue(r io.Reader, id uint32, remaining *int32) {
+	switch id {
+	case propPayloadFormatIndicator, propRequestProblemInfo, propRequestResponseInfo:
+		getUint8(r, remaining)
+	case propReceiveMaximum, propTopicAliasMaximum:
+		getUint16(r, remaining)
+	case propSessionExpiryInterval, propMessageExpiryInterval, propWillDelayInterval,
+		propMaximumPacketSize:
+		getUint32(r, remaining)
+	case propContentType, propResponseTopic, propAuthenticationMethod, propServerReference:
+		getString(r, remaining)
+	case propCorrelationData, propAuthenticationData:
+		getBinary(r, remaining)
+	case propUserProperty:
+		getString(r, remaining)
+		getString(r, remaining)
+	}
+}
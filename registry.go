@@ -0,0 +1,39 @@
+package mqtt
+
+import "sync"
+
+var (
+	registryMu sync.RWMutex
+	registry   [16]func() Message
+)
+
+// RegisterMessage registers newMessage to create the Message values that
+// messages of type msgType are decoded into, for experimenting with message
+// types that MQTT does not define. Only the reserved types 0 and 15 may be
+// registered, and ErrBadMsgType is returned for any other type. Registering a
+// type again replaces its previous registration, and a nil newMessage removes
+// it.
+//
+// A registered type is returned by NewMessage and decoded by DecodeOneMessage
+// and Decoder for any DecodeOptions.ProtocolVersion, and may be encoded with
+// Header.Encode. Any fixed header flags are permitted for it. DecodeInto does
+// not support registered types.
+func RegisterMessage(msgType MessageType, newMessage func() Message) error {
+	if msgType.IsValid() || msgType > 15 {
+		return ErrBadMsgType
+	}
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	registry[msgType] = newMessage
+	return nil
+}
+
+// registeredMessage returns the function registered for msgType, or nil.
+func registeredMessage(msgType MessageType) func() Message {
+	if msgType > 15 {
+		return nil
+	}
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	return registry[msgType]
+}
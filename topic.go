@@ -0,0 +1,33 @@
+package mqtt
+
+import "strings"
+
+// ValidTopicFilter returns true if s is a syntactically valid topic filter, as
+// subscribed to by SUBSCRIBE. A filter must not be empty, the single-level
+// wildcard '+' must occupy a whole level, and the multi-level wildcard '#'
+// must occupy the last level.
+func ValidTopicFilter(s string) bool {
+	if s == "" {
+		return false
+	}
+	levels := strings.Split(s, "/")
+	for i, level := range levels {
+		switch {
+		case level == "+":
+		case level == "#":
+			if i != len(levels)-1 {
+				return false
+			}
+		case strings.ContainsAny(level, "+#"):
+			return false
+		}
+	}
+	return true
+}
+
+// ValidTopicName returns true if s is a valid topic name, as published to by
+// PUBLISH. A name must not be empty, and must not contain the wildcards '+' or
+// '#'.
+func ValidTopicName(s string) bool {
+	return s != "" && !strings.ContainsAny(s, "+#")
+}